@@ -0,0 +1,181 @@
+// Package car exports and imports encoded ERIS trees as CARv1 streams, so that
+// content-addressed archive tooling may move ERIS blocks around.
+//
+// Each block is addressed by a CIDv1 with the raw codec and a blake2b-256
+// multihash, whose digest is exactly the ERIS reference of the block. The read
+// key is never written, so a stream only ever carries encrypted blocks.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cjslep/eris"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	cidVersion = 1
+	// Multicodec of opaque raw bytes.
+	codecRaw = 0x55
+	// Multihash code of blake2b-256.
+	mhBlake2b256 = 0xb220
+	// Maximum length of a header or section that will be read.
+	maxSectionSize = 64 * 1024 * 1024
+)
+
+// CID returns the binary CIDv1 addressing the block with the ERIS reference.
+func CID(ref [eris.RefSize]byte) []byte {
+	b := make([]byte, 0, 4*binary.MaxVarintLen64+eris.RefSize)
+	b = binary.AppendUvarint(b, cidVersion)
+	b = binary.AppendUvarint(b, codecRaw)
+	b = binary.AppendUvarint(b, mhBlake2b256)
+	b = binary.AppendUvarint(b, eris.RefSize)
+	return append(b, ref[:]...)
+}
+
+// RefFromCID returns the ERIS reference within a binary CIDv1, which must use
+// the raw codec and a blake2b-256 multihash.
+func RefFromCID(cid []byte) (ref [eris.RefSize]byte, err error) {
+	r := bytes.NewReader(cid)
+	want := []uint64{cidVersion, codecRaw, mhBlake2b256, eris.RefSize}
+	for _, w := range want {
+		var v uint64
+		v, err = binary.ReadUvarint(r)
+		if err != nil {
+			return
+		} else if v != w {
+			err = fmt.Errorf("unhandled cid: got %#x, want %#x", v, w)
+			return
+		}
+	}
+	if r.Len() != eris.RefSize {
+		err = errors.New("cid digest is not 32 bytes")
+		return
+	}
+	_, err = io.ReadFull(r, ref[:])
+	return
+}
+
+// Export writes every unique block of the tree descendent of the root
+// reference to the writer as a CARv1 stream, in depth-first order. The root
+// block is the only root of the stream.
+func Export(w io.Writer, s eris.Storage, root eris.Ref) error {
+	refs, err := eris.ListRefs(s, root)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err = writeSection(bw, header(CID(root.Ref))); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		var eb []byte
+		eb, err = s.Get(ref)
+		if err != nil {
+			return err
+		} else if blake2b.Sum256(eb) != ref {
+			return fmt.Errorf("block does not match reference %x", ref)
+		}
+		if err = writeSection(bw, CID(ref), eb); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import reads a CARv1 stream into a new in-memory Storage, returning the
+// references of the stream's roots alongside it.
+//
+// Every block must be addressed by a raw blake2b-256 CID, and is checked to
+// match its reference as it is read.
+func Import(r io.Reader) (roots [][eris.RefSize]byte, s *eris.MemStorage, err error) {
+	br := bufio.NewReader(r)
+	var hdr []byte
+	hdr, err = readSection(br)
+	if err != nil {
+		return
+	}
+	var cids [][]byte
+	cids, err = parseHeader(hdr)
+	if err != nil {
+		return
+	}
+	for _, cid := range cids {
+		var ref [eris.RefSize]byte
+		ref, err = RefFromCID(cid)
+		if err != nil {
+			return
+		}
+		roots = append(roots, ref)
+	}
+	s = eris.NewMemStorage()
+	for {
+		var sec []byte
+		sec, err = readSection(br)
+		if err == io.EOF {
+			// OK end-condition: No more sections
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		// A raw blake2b-256 CIDv1 is a fixed length, since each prefix
+		// varint is.
+		n := len(CID([eris.RefSize]byte{}))
+		if len(sec) < n {
+			err = errors.New("section too short to hold a cid")
+			return
+		}
+		var ref [eris.RefSize]byte
+		ref, err = RefFromCID(sec[:n])
+		if err != nil {
+			return
+		}
+		eb := sec[n:]
+		if blake2b.Sum256(eb) != ref {
+			err = fmt.Errorf("block does not match reference %x", ref)
+			return
+		}
+		if err = s.Put(eb, ref); err != nil {
+			return
+		}
+	}
+}
+
+// writeSection writes the varint length-prefixed concatenation of the parts.
+func writeSection(w io.Writer, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(n))); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSection reads a varint length-prefixed section, returning io.EOF only if
+// the stream ends cleanly before it.
+func readSection(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	} else if n > maxSectionSize {
+		return nil, fmt.Errorf("section of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
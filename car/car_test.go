@@ -0,0 +1,79 @@
+package car
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cjslep/eris"
+)
+
+func TestCID(t *testing.T) {
+	var ref [eris.RefSize]byte
+	copy(ref[:], "a thirty-two byte reference here")
+	cid := CID(ref)
+	want := []byte{0x01, 0x55, 0xa0, 0xe4, 0x02, 0x20}
+	if !bytes.Equal(cid[:len(want)], want) {
+		t.Errorf("got prefix %x, want %x", cid[:len(want)], want)
+	}
+	got, err := RefFromCID(cid)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if got != ref {
+		t.Errorf("got %x, want %x", got, ref)
+	}
+	cid[1] = 0x71
+	if _, err = RefFromCID(cid); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	content := make([]byte, 40*int(eris.Size1KiB)+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	src := eris.NewMemStorage()
+	root, err := eris.Encode1KiB(src.WriteFunc, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var buf bytes.Buffer
+	if err = Export(&buf, src, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	roots, s, err := Import(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if len(roots) != 1 || roots[0] != root.Ref {
+		t.Errorf("got roots %x, want %x", roots, root.Ref)
+	} else if s.Len() != src.Len() {
+		t.Errorf("got %d blocks, want %d", s.Len(), src.Len())
+	}
+	var out bytes.Buffer
+	if err = eris.Decode(s, &out, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// A corrupt block is an error.
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	if _, _, err = Import(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	cid := CID([eris.RefSize]byte{1, 2, 3})
+	roots, err := parseHeader(header(cid))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if len(roots) != 1 || !bytes.Equal(roots[0], cid) {
+		t.Errorf("got roots %x, want %x", roots, cid)
+	}
+	// {"version": 2, "roots": []}
+	v2 := []byte{0xa2, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02, 0x65, 'r', 'o', 'o', 't', 's', 0x80}
+	if _, err = parseHeader(v2); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package car
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CBOR major types used by the CARv1 header.
+const (
+	cborUint  = 0
+	cborBytes = 2
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+	cborTag   = 6
+	// Tag of a CID in DAG-CBOR.
+	cborTagCID = 42
+)
+
+// header encodes the DAG-CBOR CARv1 header {"roots": [...], "version": 1}.
+// Keys are in the canonical DAG-CBOR order: by length, then bytewise.
+func header(roots ...[]byte) []byte {
+	var b bytes.Buffer
+	writeCBORHead(&b, cborMap, 2)
+	writeCBORHead(&b, cborText, uint64(len("roots")))
+	b.WriteString("roots")
+	writeCBORHead(&b, cborArray, uint64(len(roots)))
+	for _, cid := range roots {
+		writeCBORHead(&b, cborTag, cborTagCID)
+		// A CID is prefixed with the identity multibase.
+		writeCBORHead(&b, cborBytes, uint64(len(cid)+1))
+		b.WriteByte(0)
+		b.Write(cid)
+	}
+	writeCBORHead(&b, cborText, uint64(len("version")))
+	b.WriteString("version")
+	writeCBORHead(&b, cborUint, 1)
+	return b.Bytes()
+}
+
+// parseHeader decodes a DAG-CBOR CARv1 header, returning the binary CIDs of
+// its roots. Unknown keys are rejected.
+func parseHeader(hdr []byte) (roots [][]byte, err error) {
+	r := bytes.NewReader(hdr)
+	var n uint64
+	if n, err = readCBORHeadOf(r, cborMap); err != nil {
+		return
+	}
+	version := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		var key []byte
+		if key, err = readCBORString(r, cborText); err != nil {
+			return
+		}
+		switch string(key) {
+		case "version":
+			if version, err = readCBORHeadOf(r, cborUint); err != nil {
+				return
+			}
+		case "roots":
+			var c uint64
+			if c, err = readCBORHeadOf(r, cborArray); err != nil {
+				return
+			}
+			for j := uint64(0); j < c; j++ {
+				var tag uint64
+				if tag, err = readCBORHeadOf(r, cborTag); err != nil {
+					return
+				} else if tag != cborTagCID {
+					err = fmt.Errorf("car header root has tag %d, want %d", tag, cborTagCID)
+					return
+				}
+				var cid []byte
+				if cid, err = readCBORString(r, cborBytes); err != nil {
+					return
+				} else if len(cid) == 0 || cid[0] != 0 {
+					err = errors.New("car header root lacks identity multibase prefix")
+					return
+				}
+				roots = append(roots, cid[1:])
+			}
+		default:
+			err = fmt.Errorf("car header has unknown key %q", key)
+			return
+		}
+	}
+	if version != 1 {
+		err = fmt.Errorf("unhandled car version %d", version)
+	} else if r.Len() != 0 {
+		err = errors.New("car header has trailing bytes")
+	}
+	return
+}
+
+// writeCBORHead writes the initial bytes of a CBOR data item of the major type
+// with the argument, using the shortest encoding as DAG-CBOR requires.
+func writeCBORHead(b *bytes.Buffer, major byte, arg uint64) {
+	m := major << 5
+	switch {
+	case arg < 24:
+		b.WriteByte(m | byte(arg))
+	case arg <= 0xff:
+		b.WriteByte(m | 24)
+		b.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		b.WriteByte(m | 25)
+		binary.Write(b, binary.BigEndian, uint16(arg))
+	case arg <= 0xffffffff:
+		b.WriteByte(m | 26)
+		binary.Write(b, binary.BigEndian, uint32(arg))
+	default:
+		b.WriteByte(m | 27)
+		binary.Write(b, binary.BigEndian, arg)
+	}
+}
+
+// readCBORHeadOf reads the initial bytes of a CBOR data item, requiring it to
+// be of the major type, and returns its argument.
+func readCBORHeadOf(r *bytes.Reader, major byte) (arg uint64, err error) {
+	var ib byte
+	if ib, err = r.ReadByte(); err != nil {
+		return
+	}
+	if ib>>5 != major {
+		err = fmt.Errorf("car header has cbor major type %d, want %d", ib>>5, major)
+		return
+	}
+	info := ib & 0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		buf := make([]byte, 1<<(info-24))
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		for _, c := range buf {
+			arg = arg<<8 | uint64(c)
+		}
+	default:
+		err = errors.New("car header has indefinite or reserved cbor length")
+	}
+	return
+}
+
+// readCBORString reads a CBOR byte or text string of the major type.
+func readCBORString(r *bytes.Reader, major byte) (b []byte, err error) {
+	var n uint64
+	if n, err = readCBORHeadOf(r, major); err != nil {
+		return
+	} else if n > uint64(r.Len()) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b = make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return
+}
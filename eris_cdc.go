@@ -0,0 +1,101 @@
+package eris
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+)
+
+// Chunk sizes of EncodeCDC, in blocks.
+const (
+	cdcMinBlocks = 16
+	cdcAvgBlocks = 64
+	cdcMaxBlocks = 256
+)
+
+// gearTable maps each byte to a pseudo-random value for the gear rolling hash
+// of EncodeCDC. It is generated by splitmix64 from a fixed seed, so that cut
+// points, and therefore deduplicated blocks, never change.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6572697363646300)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// EncodeCDC encodes bytes from the given Reader as a sequence of ERIS trees,
+// splitting the content at content-defined boundaries instead of only at
+// fixed block offsets. Each chunk between two boundaries is encoded like
+// Encode into spec-valid blocks emitted to the WriteFunc, and its root
+// reference returned in order. The content is the concatenation of the
+// decoded chunks, such as with DecodeAll writing every root to one writer.
+//
+// Boundaries are found with a gear rolling hash, so they move along with the
+// content around them. Inserting or removing bytes then only changes the
+// chunks near the edit, and the blocks of every other chunk are identical to
+// those of the original content. With fixed blocks, every block after the
+// edit would change.
+//
+// Chunks are between 16 and 256 blocks long, averaging 64 blocks. Empty
+// content returns no references.
+func EncodeCDC(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (refs []Ref, err error) {
+	if err = ValidBlockSize(size); err != nil {
+		return
+	}
+	min, max := cdcMinBlocks*int(size), cdcMaxBlocks*int(size)
+	mask := cdcMask(cdcAvgBlocks * int(size))
+	e := NewEncoder(w, secret, size)
+	buf := make([]byte, max)
+	n := 0
+	eof := false
+	for {
+		if !eof {
+			var m int
+			m, err = io.ReadFull(r, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return
+			}
+			err = nil
+		}
+		if n == 0 {
+			return
+		}
+		cut := cdcCut(buf[:n], min, mask)
+		e.Reset(w, secret, size)
+		var ref Ref
+		ref, err = e.Encode(bytes.NewReader(buf[:cut]))
+		if err != nil {
+			return
+		}
+		refs = append(refs, ref)
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// cdcMask returns the mask of the high bits of the gear hash that must all be
+// zero at a boundary, so that boundaries occur about every avg bytes.
+func cdcMask(avg int) uint64 {
+	b := bits.Len(uint(avg)) - 1
+	return (uint64(1)<<b - 1) << (64 - b)
+}
+
+// cdcCut returns the length of the first chunk of b: the first boundary at
+// least min bytes in, or all of b if there is none.
+func cdcCut(b []byte, min int, mask uint64) int {
+	var h uint64
+	for i, c := range b {
+		h = h<<1 + gearTable[c]
+		if i+1 >= min && h&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,68 @@
+package eris
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeCDC(t *testing.T) {
+	content := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	// The same content with bytes inserted near the start.
+	shifted := append(append(append([]byte(nil), content[:1000]...), "inserted bytes"...), content[1000:]...)
+	var b BlockAccumulator
+	refs, err := EncodeCDC((&b).Accumulate, bytes.NewReader(content), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	shiftedRefs, err := EncodeCDC((&b).Accumulate, bytes.NewReader(shifted), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for i, c := range [][]byte{content, shifted} {
+		rs := [][]Ref{refs, shiftedRefs}[i]
+		var buf bytes.Buffer
+		if err = DecodeAll(b, rs, func(int) io.Writer { return &buf }); err != nil {
+			t.Errorf("got %s, want %v", err, nil)
+		} else if !bytes.Equal(buf.Bytes(), c) {
+			t.Errorf("decoded bytes do not match content")
+		}
+		for j, r := range rs {
+			n, err := ContentSize(b, r)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if n > cdcMaxBlocks*int64(Size1KiB) || j < len(rs)-1 && n < cdcMinBlocks*int64(Size1KiB) {
+				t.Errorf("got chunk of %d bytes, want between %d and %d blocks", n, cdcMinBlocks, cdcMaxBlocks)
+			}
+		}
+	}
+	if len(refs) < 2 {
+		t.Fatalf("got %d chunks, want more than %d", len(refs), 1)
+	}
+	// Only the chunk with the insertion differs.
+	roots := make(map[[RefSize]byte]bool)
+	for _, r := range refs {
+		roots[r.Ref] = true
+	}
+	shared := 0
+	for _, r := range shiftedRefs {
+		if roots[r.Ref] {
+			shared++
+		}
+	}
+	if shared != len(refs)-1 {
+		t.Errorf("got %d shared chunks, want %d", shared, len(refs)-1)
+	}
+}
+
+func TestEncodeCDCEmpty(t *testing.T) {
+	refs, err := EncodeCDC(new(BlockAccumulator).Accumulate, bytes.NewReader(nil), nil, Size1KiB)
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if len(refs) != 0 {
+		t.Errorf("got %d references, want %d", len(refs), 0)
+	}
+}
@@ -0,0 +1,109 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// containerMagic begins every container, followed by the containerVersion.
+var containerMagic = []byte("ERIS")
+
+const containerVersion = 1
+
+// WriteContainer writes every unique block of the tree descendent of the root
+// reference to the writer as a single container, such as a portable ".eris"
+// file for sharing an encoded object offline.
+//
+// The container begins with the magic bytes "ERIS", a version byte, and the
+// binary read capability of the root reference. It is followed by one record
+// per block, in depth-first order: the block's reference, the block's length
+// as a big-endian uint32, then the encrypted block itself.
+func WriteContainer(w io.Writer, root Ref, s Storage) error {
+	rc, err := root.ReadCapability()
+	if err != nil {
+		return err
+	}
+	var hdr bytes.Buffer
+	hdr.Write(containerMagic)
+	hdr.WriteByte(containerVersion)
+	hdr.Write(rc)
+	if _, err = w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	refs, err := ListRefs(s, root)
+	if err != nil {
+		return err
+	}
+	var lbuf [4]byte
+	for _, ref := range refs {
+		var eb ebytes
+		eb, err = checkedGet(s, ref, root.BlockSize)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(lbuf[:], uint32(len(eb)))
+		if _, err = w.Write(ref[:]); err != nil {
+			return err
+		} else if _, err = w.Write(lbuf[:]); err != nil {
+			return err
+		} else if _, err = w.Write(eb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadContainer reads a container written by WriteContainer, returning the
+// root reference along with an in-memory Storage of the contained blocks.
+//
+// Every block is checked to be of the root's block size and to match its
+// reference as it is read.
+func ReadContainer(r io.Reader) (root Ref, s *MemStorage, err error) {
+	hdr := make([]byte, len(containerMagic)+1+readCapabilitySize)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		err = fmt.Errorf("reading container header: %w", err)
+		return
+	}
+	if !bytes.Equal(hdr[:len(containerMagic)], containerMagic) {
+		err = errors.New("not an eris container")
+		return
+	} else if v := hdr[len(containerMagic)]; v != containerVersion {
+		err = fmt.Errorf("unhandled container version %d", v)
+		return
+	}
+	if err = root.UnmarshalBinary(hdr[len(containerMagic)+1:]); err != nil {
+		return
+	}
+	s = NewMemStorage()
+	var rbuf [RefSize + 4]byte
+	for {
+		_, err = io.ReadFull(r, rbuf[:])
+		if err == io.EOF {
+			// OK end-condition: No more records
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		var ref [RefSize]byte
+		copy(ref[:], rbuf[:RefSize])
+		if l := binary.BigEndian.Uint32(rbuf[RefSize:]); l != uint32(root.BlockSize) {
+			err = fmt.Errorf("container record of %d bytes does not match block size", l)
+			return
+		}
+		eb := make([]byte, root.BlockSize)
+		if _, err = io.ReadFull(r, eb); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if err = verifyBlock(eb, ref, root.BlockSize); err != nil {
+			return
+		}
+		s.put(eb, ref)
+	}
+}
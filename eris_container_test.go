@@ -0,0 +1,44 @@
+package eris
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestContainer(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	var file bytes.Buffer
+	if err := WriteContainer(&file, root, b); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	got, s, err := ReadContainer(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !got.Equal(root) {
+		t.Errorf("got %v, want %v", got, root)
+	} else if s.Len() != len(b.B) {
+		t.Errorf("got %d blocks, want %d", s.Len(), len(b.B))
+	}
+	var buf bytes.Buffer
+	if err = Decode(s, &buf, got); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// A truncated record is an error.
+	_, _, err = ReadContainer(bytes.NewReader(file.Bytes()[:file.Len()-10]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	// A corrupt block is an error.
+	corrupt := append([]byte(nil), file.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	if _, _, err = ReadContainer(bytes.NewReader(corrupt)); !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("got %v, want %v", err, ErrRefMismatch)
+	}
+	if _, _, err = ReadContainer(bytes.NewReader([]byte("not a container at all, but long enough to hold a header of sixty-six bytes or more"))); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
@@ -2,9 +2,17 @@ package eris
 
 import (
 	"bytes"
+	"context"
 	"encoding/base32"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // Storage fetches a block's encrypted bytes given a particular reference,
@@ -15,111 +23,1139 @@ type Storage interface {
 	Get(ref [RefSize]byte) ([]byte, error)
 }
 
+// StorageContext is an optional interface for a Storage whose fetches may be
+// cancelled, such as one backed by the network.
+//
+// DecodeContext prefers GetContext over Get for a Storage that implements it.
+type StorageContext interface {
+	GetContext(ctx context.Context, ref [RefSize]byte) ([]byte, error)
+}
+
+// BatchStorage is an optional interface for a Storage able to fetch many
+// blocks in a single call, such as to reduce the number of round trips to a
+// remote server.
+//
+// Decode detects a Storage implementing BatchStorage and uses GetMany to fetch
+// all children of an inner node at once, instead of calling Get for each one.
+// As a result, the children of each inner node on the current path are held
+// in memory while being decoded.
+type BatchStorage interface {
+	// GetMany fetches the blocks for the references. The returned slice must
+	// have the same length as the references, with the i-th block being the
+	// one for the i-th reference. An error is returned if any block cannot
+	// be fetched.
+	GetMany(refs [][RefSize]byte) ([][]byte, error)
+}
+
+// Decoder decodes trees of encoded blocks fetched from a Storage. The zero
+// value is ready to use, decoding like the package-level Decode.
+type Decoder struct {
+	// Pool, if non-nil, supplies the buffers that fetched blocks are
+	// decrypted into, and each buffer is returned to it once its block is
+	// decoded. Values in the Pool are []byte of any capacity; a short or
+	// missing one is replaced by a new allocation.
+	//
+	// Without a Pool, a buffer is allocated for every block.
+	Pool *sync.Pool
+	// Hash, if non-nil, replaces the blake2b-256 hash used to verify that
+	// fetched blocks match their references. It must match the HashProvider
+	// the tree was encoded with.
+	Hash HashProvider
+	// Cipher, if non-nil, replaces the chacha20 stream cipher used to
+	// decrypt blocks. It must match the CipherProvider the tree was encoded
+	// with.
+	Cipher CipherProvider
+	// Padder, if non-nil, replaces the ISO/IEC 7816-4 padding stripped from
+	// the final content block. It must match the Padder the tree was encoded
+	// with.
+	Padder Padder
+	// OnProgress, if non-nil, is called after each content block is decoded
+	// and once more when decoding completes. It is passed the number of
+	// content bytes written to the writer so far, and the number of blocks
+	// fetched from the Storage so far.
+	//
+	// Since the most recent content block is withheld until its padding can
+	// be stripped, the bytes written lag the decoded content by one block
+	// until decoding completes.
+	OnProgress func(bytesWritten int64, blocksFetched int)
+	// MaxLevel, if positive, is the greatest root level that will be
+	// decoded, otherwise decoding fails with ErrLevelTooLarge before any block
+	// is fetched.
+	//
+	// The level of an ERIS tree is bounded by the size of its content, as a
+	// tree only grows a level once the content no longer fits beneath a
+	// single inner node. Since the level of a root reference is not
+	// authenticated, a MaxLevel protects against a hostile capability
+	// claiming a deep tree. Regardless of MaxLevel, a level is rejected if
+	// any tree that tall would hold more content than an int64 can measure.
+	MaxLevel int
+	// MaxBlocks, if positive, is the greatest number of blocks that will be
+	// fetched for a single call to Decode, otherwise decoding is aborted with
+	// ErrTooManyBlocks. This bounds the work a server does when decoding an
+	// untrusted capability.
+	MaxBlocks int
+	// Workers, if greater than 1, is the number of goroutines fetching the
+	// children of each inner node concurrently, before they are decoded in
+	// order. As with a BatchStorage, the children of each inner node on the
+	// current path are then held in memory while being decoded. The Storage
+	// must be safe for concurrent use.
+	//
+	// Workers is ignored for a Storage implementing BatchStorage, whose
+	// GetMany already fetches all of the children at once.
+	Workers int
+	// CacheSize, if positive, is the greatest number of bytes of blocks
+	// cached while decoding, so that a block appearing more than once, such
+	// as the content blocks of repeated content, is fetched only once. A
+	// cache is kept for each call to Decode, or is shared by all of the
+	// roots of DecodeAll.
+	//
+	// Blocks are fetched through a CachingStorage, which still fetches
+	// with the context of DecodeContext from a StorageContext, and with
+	// GetMany from a BatchStorage.
+	CacheSize int
+	// OnBlockError, if non-nil, is called when a block cannot be fetched
+	// from the Storage or does not match its reference, such as to fetch a
+	// replacement from a backup Storage. The returned block is verified and
+	// decoded in place of the failed one, while a returned error aborts
+	// decoding.
+	//
+	// It is passed the reference of the failed block and the error that
+	// fetching or verifying it returned, and is not called once the context
+	// is done. An error from GetMany of a BatchStorage is not for any one
+	// block, so it still aborts decoding.
+	OnBlockError func(ref [RefSize]byte, err error) ([]byte, error)
+	// Strict enables rejecting trees that are not exactly as Encode would
+	// produce them, though their content decodes the same. Since blocks
+	// are content-addressed, such a tree has a different root reference than
+	// the canonical one, so a malleable encoding would defeat deduplication.
+	//
+	// The final content block must be reproduced exactly by re-padding its
+	// content, otherwise decoding fails with ErrNonCanonicalPadding. With
+	// ISO/IEC 7816-4 padding, a block that unpads at all always re-pads to
+	// itself, so the shape of the tree is checked too: every inner node but
+	// the last at each level must be full, and an inner root must have more
+	// than one child, otherwise decoding fails with ErrNonCanonicalTree.
+	Strict bool
+	// Metrics, if non-nil, is notified of every block fetched and verified,
+	// and of the hits and misses of the Decoder's cache.
+	Metrics Metrics
+	// EmitPartial enables writing the content block withheld to strip its
+	// padding when decoding fails, such as when a block cannot be fetched
+	// or decrypted. All of the content decoded before the failure is then
+	// written before the error is returned, to recover what remains of a
+	// partially corrupt Storage.
+	//
+	// Since decoding did not reach the final content block, the padding of
+	// the content cannot be stripped, and the withheld block is written
+	// whole. With Workers, the blocks fetched before the failed one are still
+	// decoded, but an error from GetMany of a BatchStorage loses all of the
+	// content beneath that inner node.
+	EmitPartial bool
+	// Set by Reset, and decoded by WriteTo.
+	s    Storage
+	root Ref
+}
+
+var _ io.WriterTo = new(Decoder)
+
+// Metrics is notified of the blocks fetched by a Decoder, such as to export
+// the counts to a monitoring system. With Workers, its methods may be called
+// concurrently.
+type Metrics interface {
+	// Get is called once each block is fetched, with the error fetching
+	// it. A block served by the Decoder's cache is also counted, after a
+	// CacheHit or CacheMiss.
+	Get(err error)
+	// CacheHit is called when a block is served from the Decoder's cache
+	// without fetching it from the Storage.
+	CacheHit()
+	// CacheMiss is called when a block is not in the Decoder's cache, and
+	// is fetched from the Storage.
+	CacheMiss()
+	// Verified is called once each fetched block is checked against its
+	// reference, with the error if it does not match.
+	Verified(err error)
+}
+
+// DecoderOption configures a Decoder created with NewDecoder.
+type DecoderOption func(d *Decoder)
+
+// NewDecoder creates a Decoder configured by the options. Without options it
+// decodes like Decode.
+func NewDecoder(opts ...DecoderOption) *Decoder {
+	d := new(Decoder)
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// WithMaxLevel sets the greatest root level the Decoder decodes, as its
+// MaxLevel.
+func WithMaxLevel(level int) DecoderOption {
+	return func(d *Decoder) {
+		d.MaxLevel = level
+	}
+}
+
+// WithMaxBlocks sets the greatest number of blocks the Decoder fetches for a
+// single tree, as its MaxBlocks.
+func WithMaxBlocks(n int) DecoderOption {
+	return func(d *Decoder) {
+		d.MaxBlocks = n
+	}
+}
+
+// WithWorkers sets the number of goroutines the Decoder fetches the children of
+// an inner node with, as its Workers.
+func WithWorkers(n int) DecoderOption {
+	return func(d *Decoder) {
+		d.Workers = n
+	}
+}
+
+// WithProgress sets the callback the Decoder reports its progress to, as its
+// OnProgress.
+func WithProgress(fn func(bytesWritten int64, blocksFetched int)) DecoderOption {
+	return func(d *Decoder) {
+		d.OnProgress = fn
+	}
+}
+
+// WithCache sets the greatest number of bytes of blocks the Decoder caches, as
+// its CacheSize.
+func WithCache(maxBytes int) DecoderOption {
+	return func(d *Decoder) {
+		d.CacheSize = maxBytes
+	}
+}
+
 // Decode streams decrypted content to the writer, using the Storage to fetch
 // successive content-addressed encrypted blocks descendent of the root
 // reference.
 func Decode(s Storage, w io.Writer, root Ref) error {
+	return new(Decoder).Decode(s, w, root)
+}
+
+// DecodeContext streams decrypted content to the writer like Decode, checking
+// the context before fetching each block. If the context is done, decoding is
+// aborted and the context's error is returned.
+//
+// If the Storage also implements StorageContext, blocks are fetched with the
+// context so that an in-flight fetch may be cancelled.
+func DecodeContext(ctx context.Context, s Storage, w io.Writer, root Ref) error {
+	return new(Decoder).DecodeContext(ctx, s, w, root)
+}
+
+// DecodeBytes decodes the entire content descendent of the root reference into
+// a returned slice, for when a writer is not needed.
+//
+// The content size is computed before decoding. If max is positive, content
+// larger than max bytes is not decoded and an error wrapping ErrContentTooLarge
+// is returned, while the slice for smaller content is allocated once.
+//
+// The content size is only measured along the final path of the tree, and is
+// not authenticated until every block is decoded, so a hostile tree may claim
+// far more content than it holds. Without a positive max, the slice instead
+// grows as the content is decoded.
+func DecodeBytes(s Storage, root Ref, max int64) ([]byte, error) {
+	n, err := ContentSize(s, root)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && n > max {
+		return nil, fmt.Errorf("content of %d bytes exceeds maximum of %d bytes: %w", n, max, ErrContentTooLarge)
+	}
+	if n > math.MaxInt {
+		return nil, fmt.Errorf("content of %d bytes: %w", n, ErrContentTooLarge)
+	}
+	var buf bytes.Buffer
+	if max > 0 {
+		buf.Grow(int(n))
+	}
+	if err = Decode(s, &buf, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode streams decrypted content to the writer, using the Storage to fetch
+// successive content-addressed encrypted blocks descendent of the root
+// reference.
+//
+// The bytes returned by the Storage are never modified.
+func (d *Decoder) Decode(s Storage, w io.Writer, root Ref) error {
+	_, err := d.decode(context.Background(), s, w, root)
+	return err
+}
+
+// DecodeContext streams decrypted content to the writer like Decode, aborting
+// if the context is done like the package-level DecodeContext.
+func (d *Decoder) DecodeContext(ctx context.Context, s Storage, w io.Writer, root Ref) error {
+	_, err := d.decode(ctx, s, w, root)
+	return err
+}
+
+// Reset prepares the Decoder to decode the tree descendent of the root
+// reference from the Storage with WriteTo.
+func (d *Decoder) Reset(s Storage, root Ref) {
+	d.s = s
+	d.root = root
+}
+
+// WriteTo decodes the tree given to Reset like Decode, streaming the content
+// to the writer, and returns the number of content bytes written. This
+// implements io.WriterTo, for composing with code that pipes from one.
+//
+// Each call decodes the whole tree again. For an io.Reader over the content,
+// use NewReader instead.
+func (d *Decoder) WriteTo(w io.Writer) (n int64, err error) {
+	if d.s == nil {
+		err = errors.New("decoder has no storage: call Reset first")
+		return
+	}
+	return d.decode(context.Background(), d.s, w, d.root)
+}
+
+// DecodeAll decodes each of the roots like Decode, streaming the content of the
+// i-th root to the writer returned by w(i). Decoding stops at the first error.
+//
+// Inner nodes are fetched through a cache shared by all of the roots, so an
+// inner node common to several trees, such as when many objects with the same
+// convergence secret share content, is fetched only once. At most
+// DecodeAllCacheSize bytes of inner nodes are cached at a time, unless the
+// Decoder has a CacheSize, in which case blocks of every level are cached up
+// to that size instead.
+func (d *Decoder) DecodeAll(s Storage, roots []Ref, w func(i int) io.Writer) error {
+	var inner Storage
+	if d.CacheSize > 0 {
+		s = d.newCache(s, d.CacheSize)
+	} else {
+		inner = d.newCache(s, DecodeAllCacheSize)
+	}
+	for i, root := range roots {
+		if _, err := d.decodeWith(context.Background(), s, inner, w(i), root); err != nil {
+			return fmt.Errorf("decoding root %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// DecodeAll decodes each of the roots into the writer selected by its index,
+// sharing a cache of inner nodes among them like Decoder.DecodeAll.
+func DecodeAll(s Storage, roots []Ref, w func(i int) io.Writer) error {
+	return new(Decoder).DecodeAll(s, roots, w)
+}
+
+// DecodeAllCacheSize is the greatest number of bytes of inner nodes cached by
+// DecodeAll.
+const DecodeAllCacheSize = 64 * mb
+
+// decode implements Decode, DecodeContext, and WriteTo, returning the number
+// of content bytes written.
+func (d *Decoder) decode(ctx context.Context, s Storage, w io.Writer, root Ref) (int64, error) {
+	if d.CacheSize > 0 {
+		s = d.newCache(s, d.CacheSize)
+	}
+	return d.decodeWith(ctx, s, nil, w, root)
+}
+
+// decodeWith implements decode, fetching inner nodes from the inner Storage
+// instead if it is non-nil.
+func (d *Decoder) decodeWith(ctx context.Context, s, inner Storage, w io.Writer, root Ref) (int64, error) {
 	if err := checkBlockSize(root.BlockSize); err != nil {
-		return err
+		return 0, err
+	}
+	if err := checkLevel(root, d.MaxLevel); err != nil {
+		return 0, err
 	}
 	// Insert our own middle-writer to keep a one-block buffer
 	// in memory, so that the final block may have its padding
 	// properly stripped
-	sink := newPaddingSink(w, root.BlockSize)
+	t := &treeDecoder{
+		d:     d,
+		ctx:   ctx,
+		s:     s,
+		inner: inner,
+		sink:  newPaddingSink(w, root.BlockSize),
+		size:  root.BlockSize,
+		level: root.Level,
+	}
+	t.sink.padder = d.prims().padProvider()
 	// Decode the tree.
-	err := decodeRecur(s, sink, root.Level, root.Ref, root.Key, root.BlockSize)
+	err := t.decodeRecur(root.Level, root.Ref, root.Key, true)
 	if err != nil {
-		return err
+		if d.EmitPartial {
+			// The decoding error takes precedence over writing.
+			t.sink.Drain()
+		}
+		return t.sink.n, err
+	}
+	if d.Strict {
+		if err = checkCanonicalPadding(t.sink.padder, t.sink.buf); err != nil {
+			return t.sink.n, err
+		}
 	}
 	// Strip the padding from the final content block.
-	_, err = sink.Flush()
-	return err
+	_, err = t.sink.Flush()
+	if err != nil {
+		return t.sink.n, err
+	}
+	t.progress()
+	return t.sink.n, nil
+}
+
+// treeDecoder holds the state of a single call to decode a tree.
+type treeDecoder struct {
+	d   *Decoder
+	ctx context.Context
+	s   Storage
+	// Storage inner nodes are fetched from, if not nil.
+	inner Storage
+	sink  *paddingSink
+	size  BlockSize
+	// Level of the root.
+	level int
+	// Number of blocks fetched so far.
+	fetched int
+}
+
+// progress reports the bytes written and blocks fetched so far, if the
+// Decoder has an OnProgress callback.
+func (t *treeDecoder) progress() {
+	if t.d.OnProgress != nil {
+		t.d.OnProgress(t.sink.n, t.fetched)
+	}
+}
+
+// reserve ensures that fetching n more blocks does not exceed the Decoder's
+// MaxBlocks.
+func (t *treeDecoder) reserve(n int) error {
+	if t.d.MaxBlocks > 0 && t.fetched+n > t.d.MaxBlocks {
+		return fmt.Errorf("fetching more than %d blocks: %w", t.d.MaxBlocks, ErrTooManyBlocks)
+	}
+	return nil
 }
 
 // decodeRecur applies a recursive depth-first decoding of the encoded tree.
-func decodeRecur(s Storage, w io.Writer, level int, ref [RefSize]byte, key [KeySize]byte, size BlockSize) error {
+//
+// The final block at each level, on the path to the final content block, is
+// marked as last.
+func (t *treeDecoder) decodeRecur(level int, ref [RefSize]byte, key [KeySize]byte, last bool) error {
 	// 1. Obtain the Block of data
-	eb, err := checkedGet(s, ref, size)
-	if err != nil {
+	if err := t.ctx.Err(); err != nil {
 		return err
 	}
-	ub, err := decrypt(eb, key)
+	if err := t.reserve(1); err != nil {
+		return err
+	}
+	src := t.s
+	if level > 0 && t.inner != nil {
+		src = t.inner
+	}
+	b, err := getBlock(t.ctx, src, ref)
+	t.fetched++
+	if t.d.Metrics != nil {
+		t.d.Metrics.Get(err)
+	}
+	if b, err = t.checkBlock(ref, b, err); err != nil {
+		return err
+	}
+	return t.decodeBlock(level, b, key, last)
+}
+
+// checkBlock verifies a block fetched with the given error, substituting the
+// block returned by the Decoder's OnBlockError if either the fetch or the
+// verification failed.
+func (t *treeDecoder) checkBlock(ref [RefSize]byte, b []byte, err error) ([]byte, error) {
+	if err == nil {
+		if err = t.verify(b, ref); err == nil {
+			return b, nil
+		}
+	}
+	if t.d.OnBlockError == nil {
+		return nil, err
+	} else if cerr := t.ctx.Err(); cerr != nil {
+		return nil, cerr
+	}
+	if b, err = t.d.OnBlockError(ref, err); err != nil {
+		return nil, err
+	}
+	if err = t.verify(b, ref); err != nil {
+		return nil, fmt.Errorf("replacement block: %w", err)
+	}
+	return b, nil
+}
+
+// verify checks the block against its reference, notifying the Decoder's
+// Metrics.
+func (t *treeDecoder) verify(b []byte, ref [RefSize]byte) error {
+	err := t.d.prims().verifyBlock(b, ref, t.size)
+	if t.d.Metrics != nil {
+		t.d.Metrics.Verified(err)
+	}
+	return err
+}
+
+// decodeBlock decrypts an already-fetched and verified encrypted block into a
+// buffer from the Pool, recurring into its children if it is an inner node.
+func (t *treeDecoder) decodeBlock(level int, eb []byte, key [KeySize]byte, last bool) error {
+	ub, err := t.d.prims().decryptTo(t.d.getBuf(t.size), eb, key)
 	if err != nil {
 		return err
 	}
+	defer t.d.putBuf(ub)
+	if level > 0 {
+		if err = checkInnerNode(ub); err != nil {
+			return err
+		}
+		if t.d.Strict {
+			if err = t.checkCanonicalNode(level, ub, last); err != nil {
+				return err
+			}
+		}
+	}
 	// 2. Determine whether this is a Content block or inner node.
 	if level == 0 {
 		// Content: Emit
-		_, err = w.Write(ub)
+		_, err = t.sink.Write(ub)
 		if err != nil {
 			return err
 		}
+		t.progress()
 		return nil
-	} else {
-		// Inner node: Recur decoding the tree.
-		bb := bytes.NewBuffer(ub)
-		var rbuf [RefSize]byte
-		var kbuf [KeySize]byte
-		for {
-			_, err = io.ReadFull(bb, rbuf[:])
-			if err == io.EOF {
-				// OK end-condition: We reach the end of the block
-				return nil
-			} else if err != nil {
+	} else if bs, ok := t.s.(BatchStorage); ok || t.d.Workers > 1 {
+		// Inner node: Fetch all children at once, then recur.
+		n := childCount(ub)
+		refs := make([][RefSize]byte, n)
+		keys := make([][KeySize]byte, n)
+		for i := 0; i < n; i++ {
+			refs[i], keys[i] = refKeyPairAt(ub, i)
+		}
+		if err = t.ctx.Err(); err != nil {
+			return err
+		}
+		if err = t.reserve(n); err != nil {
+			return err
+		}
+		var blocks [][]byte
+		var errs []error
+		if ok {
+			// Inner nodes are fetched through the inner cache, which is
+			// a BatchStorage whenever the Storage is one.
+			if ibs, iok := t.inner.(BatchStorage); iok && level-1 > 0 {
+				bs = ibs
+			}
+			blocks, err = bs.GetMany(refs)
+			if t.d.Metrics != nil {
+				for i := 0; i < n; i++ {
+					t.d.Metrics.Get(err)
+				}
+			}
+			if err != nil {
+				return err
+			} else if len(blocks) != n {
+				return errors.New("error fetching references from BatchStorage: returned incorrect number of blocks")
+			}
+		} else if blocks, errs, err = t.getConcurrent(level-1, refs); err != nil {
+			return err
+		}
+		t.fetched += n
+		for i := 0; i < n; i++ {
+			var ferr error
+			if errs != nil {
+				ferr = errs[i]
+			}
+			if blocks[i], err = t.checkBlock(refs[i], blocks[i], ferr); err != nil {
+				return err
+			}
+			err = t.decodeBlock(level-1, blocks[i], keys[i], last && i == n-1)
+			if err != nil {
 				return err
 			}
-			_, err = io.ReadFull(bb, kbuf[:])
+			// Release the block once decoded.
+			blocks[i] = nil
+		}
+		return nil
+	} else {
+		// Inner node: Recur decoding the tree, up to the padding.
+		n := childCount(ub)
+		for i := 0; i < n; i++ {
+			r, k := refKeyPairAt(ub, i)
+			err = t.decodeRecur(level-1, r, k, last && i == n-1)
 			if err != nil {
 				return err
 			}
-			if refKeyPairAllZero(rbuf, kbuf) {
-				// OK end-condition: Padded empty
+		}
+		return nil
+	}
+}
+
+// checkCanonicalNode enforces that the inner node has the shape Encode gives
+// it: every inner node but the last at each level is full, and the root has
+// more than one child since otherwise the tree is taller than needed.
+func (t *treeDecoder) checkCanonicalNode(level int, ub ubytes, last bool) error {
+	n := childCount(ub)
+	if !last && n < Arity(t.size) {
+		return fmt.Errorf("level %d inner node has %d of %d children: %w", level, n, Arity(t.size), ErrNonCanonicalTree)
+	} else if level == t.level && n < 2 {
+		return fmt.Errorf("root inner node has a single child: %w", ErrNonCanonicalTree)
+	}
+	return nil
+}
+
+// newCache creates a CachingStorage around the Storage, notifying the
+// Decoder's Metrics of its hits and misses. The CachingStorage is a
+// BatchStorage if the Storage is one.
+func (d *Decoder) newCache(s Storage, maxBytes int) Storage {
+	c := NewCachingStorage(s, maxBytes)
+	c.metrics = d.Metrics
+	if bs, ok := s.(BatchStorage); ok {
+		return batchCachingStorage{CachingStorage: c, bs: bs}
+	}
+	return c
+}
+
+// getConcurrent fetches the blocks of the given level with the Decoder's
+// Workers, returning them in the order of the references.
+//
+// With an OnBlockError or EmitPartial, a failed fetch does not stop the others,
+// and instead the errors of each fetch are returned in the same order.
+func (t *treeDecoder) getConcurrent(level int, refs [][RefSize]byte) (blocks [][]byte, errs []error, err error) {
+	src := t.s
+	if level > 0 && t.inner != nil {
+		src = t.inner
+	}
+	blocks = make([][]byte, len(refs))
+	errs = make([]error, len(refs))
+	g, ctx := errgroup.WithContext(t.ctx)
+	g.SetLimit(t.d.Workers)
+	for i := range refs {
+		i := i
+		g.Go(func() error {
+			blocks[i], errs[i] = getBlock(ctx, src, refs[i])
+			if t.d.Metrics != nil {
+				t.d.Metrics.Get(errs[i])
+			}
+			if t.d.OnBlockError != nil || t.d.EmitPartial {
 				return nil
 			}
-			err = decodeRecur(s, w, level-1, rbuf, kbuf, size)
+			return errs[i]
+		})
+	}
+	if err = g.Wait(); err != nil {
+		blocks, errs = nil, nil
+	}
+	return
+}
+
+// prims determines the primitives blocks are decoded with.
+func (d *Decoder) prims() primitives {
+	return primitives{hash: d.Hash, cipher: d.Cipher, padder: d.Padder}
+}
+
+// getBuf obtains a buffer of the block size from the Pool, or allocates one.
+func (d *Decoder) getBuf(size BlockSize) []byte {
+	return getPoolBuf(d.Pool, size)
+}
+
+// putBuf returns the buffer to the Pool, if there is one.
+func (d *Decoder) putBuf(b []byte) {
+	putPoolBuf(d.Pool, b)
+}
+
+// getPoolBuf obtains a buffer of the block size from the pool, allocating one
+// if the pool is nil, empty, or holds too small a buffer.
+func getPoolBuf(pool *sync.Pool, size BlockSize) []byte {
+	if pool != nil {
+		if b, ok := pool.Get().([]byte); ok && cap(b) >= int(size) {
+			return b[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+// putPoolBuf returns the buffer to the pool, unless it is nil.
+func putPoolBuf(pool *sync.Pool, b []byte) {
+	if pool != nil {
+		pool.Put(b)
+	}
+}
+
+// DecodeRange streams the decrypted content within the byte range of the given
+// offset and length to the writer.
+//
+// Subtrees covering content entirely outside of the range are skipped without
+// being fetched, so only the inner nodes and content blocks overlapping the
+// range are fetched from the Storage. The final content block still has its
+// padding stripped when the range includes it.
+//
+// Returns io.ErrUnexpectedEOF if the content ends before the range does, after
+// writing the content within the range.
+func DecodeRange(s Storage, w io.Writer, root Ref, offset, length int64) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	}
+	if err := checkLevel(root, 0); err != nil {
+		return err
+	}
+	if offset < 0 || length < 0 {
+		return errors.New("negative range")
+	} else if offset > math.MaxInt64-length {
+		return fmt.Errorf("range end: %w", ErrContentTooLarge)
+	} else if length == 0 {
+		return nil
+	}
+	d := rangeDecoder{
+		s:     s,
+		w:     w,
+		size:  root.BlockSize,
+		start: offset,
+		end:   offset + length,
+	}
+	err := d.decodeRecur(root.Level, root.Ref, root.Key, 0, true)
+	if err != nil {
+		return err
+	}
+	if d.written < length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// DecodeAt decodes the content descendent of the root reference into the
+// WriterAt, writing each content block at the offset given by its position in
+// the tree instead of in order. The final content block has its padding
+// stripped before it is written, so nothing is written past the content.
+//
+// If the WriterAt also has a Truncate(size int64) error method, like *os.File,
+// it is truncated to the content size once every block is written, such as to
+// shrink a file preallocated to a larger size.
+func DecodeAt(s Storage, w io.WriterAt, root Ref) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	}
+	if err := checkLevel(root, 0); err != nil {
+		return err
+	}
+	d := atDecoder{
+		s:    s,
+		w:    w,
+		size: root.BlockSize,
+	}
+	if err := d.decodeRecur(root.Level, root.Ref, root.Key, 0, true); err != nil {
+		return err
+	}
+	if t, ok := w.(interface{ Truncate(size int64) error }); ok {
+		return t.Truncate(d.end)
+	}
+	return nil
+}
+
+// DecodeToFile decodes the content descendent of the root reference into the
+// file at the path. The content is written with DecodeAt, and the file is
+// truncated to the exact content size once the final content block has its
+// padding stripped, even when the content is a single block.
+//
+// The content is decoded into a temporary file in the same directory, which is
+// renamed into place only once decoding succeeds. A failed decode leaves any
+// existing file at the path untouched, and no partial content behind.
+func DecodeToFile(s Storage, path string, root Ref) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = DecodeAt(s, tmp, root)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// atDecoder holds the state of a single call to DecodeAt.
+type atDecoder struct {
+	s    Storage
+	w    io.WriterAt
+	size BlockSize
+	// Offset just past the final content byte, once written
+	end int64
+}
+
+// decodeRecur applies a recursive depth-first decoding of the tree, writing
+// each content block at the offset of its index, which for the first content
+// block beneath this one is base.
+func (d *atDecoder) decodeRecur(level int, ref [RefSize]byte, key [KeySize]byte, base int64, last bool) error {
+	eb, err := checkedGet(d.s, ref, d.size)
+	if err != nil {
+		return err
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return err
+	}
+	bs := int64(d.size)
+	if level == 0 {
+		if last {
+			ub, err = unpad(ub)
+			if err != nil {
+				return err
+			}
+		}
+		if base > (math.MaxInt64-bs)/bs {
+			return fmt.Errorf("content offset: %w", ErrContentTooLarge)
+		}
+		off := base * bs
+		if _, err = d.w.WriteAt(ub, off); err != nil {
+			return err
+		}
+		if last {
+			d.end = off + int64(len(ub))
+		}
+		return nil
+	}
+	if err = checkInnerNode(ub); err != nil {
+		return err
+	}
+	span, err := blocksAtLevel(d.size, level-1)
+	if err != nil {
+		span = math.MaxInt64
+	}
+	c := childCount(ub)
+	for i := 0; i < c; i++ {
+		if int64(i) > (math.MaxInt64-base)/span {
+			return fmt.Errorf("content offset: %w", ErrContentTooLarge)
+		}
+		r, k := refKeyPairAt(ub, i)
+		err = d.decodeRecur(level-1, r, k, base+int64(i)*span, last && i == c-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeDecoder holds the state of a DecodeRange call.
+type rangeDecoder struct {
+	s    Storage
+	w    io.Writer
+	size BlockSize
+	// Requested byte range [start, end)
+	start int64
+	end   int64
+	// Number of content bytes written
+	written int64
+}
+
+// decodeRecur applies a recursive depth-first decoding of the subtrees
+// overlapping the range. The base is the index of the first content block
+// descendent of the block, and last indicates whether the block is on the
+// rightmost path of the tree.
+func (d *rangeDecoder) decodeRecur(level int, ref [RefSize]byte, key [KeySize]byte, base int64, last bool) error {
+	eb, err := checkedGet(d.s, ref, d.size)
+	if err != nil {
+		return err
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return err
+	}
+	bs := int64(d.size)
+	if level == 0 {
+		if last {
+			ub, err = unpad(ub)
 			if err != nil {
 				return err
 			}
 		}
+		// Trim the content block to the range.
+		from := base * bs
+		lo, hi := int64(0), int64(len(ub))
+		if d.start > from {
+			lo = d.start - from
+		}
+		if d.end-from < hi {
+			hi = d.end - from
+		}
+		if lo >= hi {
+			return nil
+		}
+		n, err := d.w.Write(ub[lo:hi])
+		d.written += int64(n)
+		return err
+	}
+	// Inner node; a child spanning beyond int64 can only be the first one
+	// within the range.
+	if err = checkInnerNode(ub); err != nil {
+		return err
+	}
+	span, err := blocksAtLevel(d.size, level-1)
+	if err != nil {
+		span = math.MaxInt64
+	}
+	first, final := d.start/bs, (d.end-1)/bs
+	c := childCount(ub)
+	for i := 0; i < c; i++ {
+		if int64(i) > (math.MaxInt64-base)/span {
+			return nil
+		}
+		cb := base + int64(i)*span
+		if cb > final {
+			return nil
+		} else if cb <= math.MaxInt64-span && cb+span <= first {
+			// Subtree entirely before the range.
+			continue
+		}
+		r, k := refKeyPairAt(ub, i)
+		err = d.decodeRecur(level-1, r, k, cb, last && i == c-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyError is returned by Verify when a block in the tree fails its
+// integrity check, or could not be fetched.
+type VerifyError struct {
+	// Reference and level of the block that failed.
+	Ref   [RefSize]byte
+	Level int
+	Err   error
+}
+
+// Error describes the failing block and the reason it failed.
+func (v VerifyError) Error() string {
+	return fmt.Sprintf("verify failed for level %d ref=%s: %s",
+		v.Level,
+		base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(v.Ref[:]),
+		v.Err)
+}
+
+// Unwrap returns the reason the block failed.
+func (v VerifyError) Unwrap() error {
+	return v.Err
+}
+
+// Verify checks that every block in the tree descendent of the root reference
+// is present in the Storage, is of the proper size, and matches its
+// reference. Inner nodes are decrypted to discover their children, but the
+// content is discarded.
+//
+// Returns the first failure found as a VerifyError.
+func Verify(s Storage, root Ref) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	} else if err = checkLevel(root, 0); err != nil {
+		return err
+	}
+	return verifyRecur(s, root.Level, root.Ref, root.Key, root.BlockSize)
+}
+
+// DecodeVerified streams decrypted content to the writer like Decode, but only
+// once Verify has found every block of the tree to be intact, so that a
+// missing or corrupt block results in nothing being written rather than a
+// partial prefix of the content.
+//
+// Every block is fetched twice, once by each pass. Wrapping the Storage with
+// NewCachingStorage large enough for the whole tree avoids fetching from the
+// underlying Storage twice. The padding of the final content block is only
+// checked while decoding, as is every block if the Storage may change between
+// the passes, so the writer may still see a partial prefix in those cases.
+func DecodeVerified(s Storage, w io.Writer, root Ref) error {
+	if err := Verify(s, root); err != nil {
+		return err
+	}
+	return Decode(s, w, root)
+}
+
+// verifyRecur applies a recursive depth-first verification of the tree.
+func verifyRecur(s Storage, level int, ref [RefSize]byte, key [KeySize]byte, size BlockSize) error {
+	eb, err := checkedGet(s, ref, size)
+	if err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	} else if level == 0 {
+		return nil
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	} else if err = checkInnerNode(ub); err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	}
+	for i := 0; i < childCount(ub); i++ {
+		r, k := refKeyPairAt(ub, i)
+		if err = verifyRecur(s, level-1, r, k, size); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// decrypt applies the symmetric key to decrypt in-place.
+// decrypt applies the symmetric key to decrypt in-place, overwriting the
+// encrypted block with its plaintext. This avoids a copy when the caller
+// exclusively owns the block.
 func decrypt(block ebytes, key [KeySize]byte) (ubytes, error) {
-	c, err := newSymmKeyCipher(key)
+	return decryptTo(ubytes(block), block, key)
+}
+
+// decryptTo applies the symmetric key to decrypt the encrypted block into the
+// destination, which must be at least as long, returning the plaintext
+// subslice of it. The encrypted block is left unmodified unless it is also
+// the destination.
+func decryptTo(dst []byte, src []byte, key [KeySize]byte) (ubytes, error) {
+	return primitives{}.decryptTo(dst, src, key)
+}
+
+// decryptTo implements decryptTo using the primitives.
+func (p primitives) decryptTo(dst []byte, src []byte, key [KeySize]byte) (ubytes, error) {
+	if len(dst) < len(src) {
+		return nil, errors.New("decryption destination shorter than block")
+	}
+	c, err := p.cipherProvider().NewStream(key)
 	if err != nil {
 		return nil, err
 	}
-	// Decrypt in-place
-	c.XORKeyStream(block[:], block)
-	return ubytes(block), nil
+	dst = dst[:len(src)]
+	c.XORKeyStream(dst, src)
+	return ubytes(dst), nil
 }
 
 // checkedGet fetches the block from the storage, ensures the block is of the
 // expected proper size, and then computes the returned encrypted data's hash
 // to ensure the proper reference was indeed fetched by the Storage.
+//
+// The returned block is a copy of the bytes returned by the Storage, so that
+// it may be decrypted in-place without corrupting a Storage that hands out
+// cached or memory-mapped buffers.
 func checkedGet(s Storage, ref [RefSize]byte, size BlockSize) (eb ebytes, err error) {
+	return checkedGetContext(context.Background(), s, ref, size)
+}
+
+// checkedGetContext implements checkedGet, fetching the block with the context
+// if the Storage implements StorageContext.
+func checkedGetContext(ctx context.Context, s Storage, ref [RefSize]byte, size BlockSize) (eb ebytes, err error) {
 	var b []byte
-	b, err = s.Get(ref)
+	b, err = getBlock(ctx, s, ref)
 	if err != nil {
 		return
 	}
-	eb = ebytes(b)
+	return checkBlock(b, ref, size)
+}
+
+// getBlock fetches the block from the Storage without verifying it, using the
+// context if the Storage implements StorageContext.
+func getBlock(ctx context.Context, s Storage, ref [RefSize]byte) ([]byte, error) {
+	if sc, ok := s.(StorageContext); ok {
+		return sc.GetContext(ctx, ref)
+	}
+	return s.Get(ref)
+}
+
+// checkBlock copies the fetched bytes into a fresh encrypted block, ensuring it
+// is the proper size and matches the reference.
+func checkBlock(b []byte, ref [RefSize]byte, size BlockSize) (eb ebytes, err error) {
+	eb = make(ebytes, len(b))
+	copy(eb, b)
+	err = verifyBlock(eb, ref, size)
+	return
+}
+
+// VerifyBlock checks that the encrypted block is of the block size and hashes
+// to the reference, such as to reject a corrupt block when it is stored rather
+// than when it is later decoded. The block is not modified.
+//
+// A block hashing to another reference is reported as a RefMismatchError.
+func VerifyBlock(eblock []byte, ref [RefSize]byte, size BlockSize) error {
+	if err := checkBlockSize(size); err != nil {
+		return err
+	}
+	return verifyBlock(eblock, ref, size)
+}
+
+// verifyBlock ensures the fetched bytes are the proper size and match the
+// reference, without modifying them.
+func verifyBlock(b []byte, ref [RefSize]byte, size BlockSize) error {
+	return primitives{}.verifyBlock(b, ref, size)
+}
+
+// verifyBlock implements verifyBlock using the primitives.
+func (p primitives) verifyBlock(b []byte, ref [RefSize]byte, size BlockSize) error {
 	// Quick check: ensure the block is the proper size
-	if int(size) != len(eb) {
-		err = errors.New("error fetching reference from Storage: returned block incorrect size")
-		return
+	if len(b) == 0 {
+		return fmt.Errorf("error fetching reference from Storage: %w", ErrEmptyStorageResult)
+	} else if len(b) < int(size) {
+		return fmt.Errorf("error fetching reference from Storage: returned block of %d bytes, want %d: %w", len(b), size, ErrBlockTooShort)
+	} else if len(b) > int(size) {
+		return fmt.Errorf("error fetching reference from Storage: returned block of %d bytes, want %d: %w", len(b), size, ErrBlockTooLong)
 	}
 	// Ensure the retrieved data matches
-	ch := toRef(eb)
+	ch := p.toRef(b)
 	for i := 0; i < RefSize; i++ {
 		if ch[i] != ref[i] {
-			err = errors.New("error fetching reference from Storage: returned block did not match reference=" +
-				base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:]))
-			return
+			return RefMismatchError{Expected: ref, Got: ch, Size: size}
 		}
 	}
-	return
+	return nil
+}
+
+// RefMismatchError is returned when a block fetched from a Storage does not
+// hash to the reference it was fetched with, indicating the Storage returned
+// corrupt data. It is also returned when a block being stored does not hash to
+// the reference it is stored under.
+type RefMismatchError struct {
+	// Reference the block was fetched or stored with.
+	Expected [RefSize]byte
+	// Reference the block actually hashes to.
+	Got [RefSize]byte
+	// Size of the block being fetched, or zero for a block being stored.
+	Size BlockSize
+	// Storing is true for a block being stored rather than fetched.
+	Storing bool
+}
+
+// Error describes the expected reference.
+func (r RefMismatchError) Error() string {
+	ref := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(r.Expected[:])
+	if r.Storing {
+		return "error storing block in Storage: block did not match reference=" + ref
+	}
+	return "error fetching reference from Storage: returned block did not match reference=" + ref
+}
+
+// Unwrap returns ErrRefMismatch.
+func (r RefMismatchError) Unwrap() error {
+	return ErrRefMismatch
+}
+
+// checkInnerNode enforces that an unencrypted inner node holds a whole number
+// of reference-key pairs, returning ErrMalformedInnerNode otherwise.
+//
+// The specification pads an inner node with all-zero pairs only after its
+// final child, so a non-zero pair following an all-zero one is also rejected.
+// Otherwise the children after the spurious all-zero pair would be silently
+// dropped.
+func checkInnerNode(ub ubytes) error {
+	if len(ub)%(RefSize+KeySize) != 0 {
+		return fmt.Errorf("inner node of %d bytes is not a multiple of %d: %w", len(ub), RefSize+KeySize, ErrMalformedInnerNode)
+	}
+	c := childCount(ub)
+	for i, b := range ub[c*(RefSize+KeySize):] {
+		if b != 0 {
+			return fmt.Errorf("inner node has a reference-key pair at index %d after padding: %w", c+i/(RefSize+KeySize), ErrMalformedInnerNode)
+		}
+	}
+	return nil
 }
 
 // refKeyPairAllZero returns true when both the reference and key bytes are all
@@ -147,7 +1183,38 @@ func checkBlockSize(bs BlockSize) error {
 	case Size32KiB:
 		return nil
 	default:
-		return errors.New("unhandled block size")
+		return ErrUnhandledBlockSize
+	}
+}
+
+// checkLevel enforces that the root level is possible for its block size, and
+// does not exceed the maximum level if it is positive.
+func checkLevel(root Ref, max int) error {
+	if root.Level < 0 {
+		return errors.New("root level is negative")
+	}
+	limit := maxTreeLevel(root.BlockSize)
+	if max > 0 && max < limit {
+		limit = max
+	}
+	if root.Level > limit {
+		return fmt.Errorf("root level %d exceeds maximum of %d: %w", root.Level, limit, ErrLevelTooLarge)
+	}
+	return nil
+}
+
+// maxTreeLevel determines the greatest level of a tree of the block size whose
+// content can be measured in an int64. A tree at any greater level holds more
+// content blocks than a single inner node at the level below can, each of
+// which is full.
+func maxTreeLevel(size BlockSize) int {
+	level := 0
+	for {
+		n, err := blocksAtLevel(size, level)
+		if err != nil || n > math.MaxInt64/int64(size) {
+			return level
+		}
+		level++
 	}
 }
 
@@ -155,17 +1222,24 @@ func checkBlockSize(bs BlockSize) error {
 // writer for all blocks except the final one. The final block has its trailing
 // padding stripped.
 type paddingSink struct {
-	w     io.Writer
-	buf   []byte
-	first bool
+	w      io.Writer
+	padder Padder
+	buf    []byte
+	first  bool
+	// Whether the buffer holds a block not yet written to the underlying
+	// writer.
+	held bool
+	// Number of bytes written to the underlying writer.
+	n int64
 }
 
 // newPaddingSink creates a new paddingSink.
 func newPaddingSink(w io.Writer, size BlockSize) *paddingSink {
 	return &paddingSink{
-		w:     w,
-		buf:   make([]byte, size),
-		first: true,
+		w:      w,
+		padder: ISO7816{},
+		buf:    make([]byte, size),
+		first:  true,
 	}
 }
 
@@ -175,33 +1249,110 @@ func newPaddingSink(w io.Writer, size BlockSize) *paddingSink {
 // to the underlying writer.
 func (p *paddingSink) Write(b []byte) (n int, err error) {
 	if !p.first {
+		p.held = false
 		n, err = p.w.Write(p.buf)
+		p.n += int64(n)
+		if err != nil {
+			return
+		}
 	}
 	p.first = false
 	if len(p.buf) != len(b) {
 		return 0, errors.New("mismatched padding buffer and block size")
 	}
 	copy(p.buf, b)
+	p.held = true
 	return len(p.buf), nil
 }
 
+// Drain writes the block held in the sink's buffer, if any, to the underlying
+// writer without stripping its padding.
+func (p *paddingSink) Drain() (int, error) {
+	if !p.held {
+		return 0, nil
+	}
+	p.held = false
+	n, err := p.w.Write(p.buf)
+	p.n += int64(n)
+	return n, err
+}
+
 // Flush applies the unpadding algorithm to the block within the sink's buffer.
 func (p *paddingSink) Flush() (int, error) {
-	idx := len(p.buf) - 1
+	b, err := p.padder.Unpad(p.buf)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	return n, err
+}
+
+// Unpad returns the prefix of the buffer preceding its ISO/IEC 7816-4 padding,
+// which is the final 0x80 byte and the zero bytes following it. Returns a
+// BadPaddingError if a non-zero byte other than 0x80 follows the content, or
+// if there is no 0x80 byte. The returned slice shares the buffer.
+func Unpad(buf []byte) ([]byte, error) {
+	return unpad(buf)
+}
+
+// checkCanonicalPadding enforces that re-padding the content of the final
+// content block with the Padder reproduces the block exactly.
+func checkCanonicalPadding(p Padder, ub ubytes) error {
+	b, err := p.Unpad(ub)
+	if err != nil {
+		return err
+	}
+	re := p.Pad(append(make(ubytes, 0, len(ub)), b...), BlockSize(len(ub)))
+	if !bytes.Equal(re, ub) {
+		return ErrNonCanonicalPadding
+	}
+	return nil
+}
+
+// unpad strips the trailing padding from a final content block, returning the
+// subslice of the content.
+func unpad(b ubytes) (ubytes, error) {
+	idx := len(b) - 1
 	found := false
 	for ; idx >= 0; idx-- {
-		if p.buf[idx] == 0x80 {
+		if b[idx] == 0x80 {
 			found = true
 			break
-		} else if p.buf[idx] != 0 {
-			return 0, errors.New("content block padding malformed")
+		} else if b[idx] != 0 {
+			return nil, BadPaddingError{Offset: idx}
 		}
 	}
 	if !found {
-		return 0, errors.New("last content block was improperly padded")
+		return nil, BadPaddingError{MissingMarker: true}
 	}
-	if idx <= 0 {
-		return 0, nil
+	return b[:idx], nil
+}
+
+// BadPaddingError is returned when the final content block is improperly
+// padded.
+type BadPaddingError struct {
+	// Offset within the final content block of the non-zero byte found before
+	// the padding marker. It is zero when the marker is missing, as the scan
+	// reached the start of the block.
+	Offset int
+	// MissingMarker is true when the block is entirely zero, lacking the 0x80
+	// padding marker.
+	MissingMarker bool
+}
+
+// Error describes where the padding was malformed.
+func (b BadPaddingError) Error() string {
+	if b.MissingMarker {
+		return "last content block was improperly padded: missing padding marker"
 	}
-	return p.w.Write(p.buf[:idx])
+	return fmt.Sprintf("content block padding malformed at offset %d", b.Offset)
+}
+
+// Unwrap returns ErrBadPadding.
+func (b BadPaddingError) Unwrap() error {
+	return ErrBadPadding
 }
@@ -2,13 +2,19 @@ package eris
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
+	"crypto/subtle"
+	"encoding"
 	"encoding/base32"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"math"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/chacha20"
@@ -24,10 +30,69 @@ const (
 const (
 	RefSize = 32
 	KeySize = 32
+	// MaxSecretSize is the longest convergence secret, which keys the
+	// blake2b hash of each block so is limited to blake2b's maximum key size.
+	MaxSecretSize = blake2b.Size
 )
 
 const (
 	erisURNVersion = "erisx2"
+	// secretKDFLabel keys the hash of DeriveSecret.
+	secretKDFLabel = "eris convergence secret"
+)
+
+// Errors returned while encoding and decoding, which may be tested against
+// with errors.Is.
+var (
+	// ErrUnhandledBlockSize is returned for a block size other than 1KiB or
+	// 32KiB where only those are supported.
+	ErrUnhandledBlockSize = errors.New("unhandled block size")
+	// ErrBlockSizeMultiple is returned for a block size that is not an even
+	// multiple of the reference-key pair size.
+	ErrBlockSizeMultiple = errors.New("block size is not an even multiple of reference-key pair size")
+	// ErrBlockSizeTooSmall is returned for a block size too small to hold
+	// the two reference-key pairs an inner node needs to build a tree.
+	ErrBlockSizeTooSmall = errors.New("block size must hold at least two reference-key pairs")
+	// ErrLevelTooLarge is returned for a tree level that does not fit in the
+	// single byte of a read capability.
+	ErrLevelTooLarge = errors.New("level exceeds 1 byte depth")
+	// ErrBadPadding is returned when the final content block is not properly
+	// padded.
+	ErrBadPadding = errors.New("content block padding malformed")
+	// ErrRefMismatch is returned when a fetched block does not hash to its
+	// reference, so another source may still have the correct block.
+	ErrRefMismatch = errors.New("block does not match reference")
+	// ErrTooManyBlocks is returned when decoding would fetch more blocks
+	// than permitted.
+	ErrTooManyBlocks = errors.New("too many blocks")
+	// ErrContentTooLarge is returned when a content size or offset within a
+	// tree does not fit in an int64, such as for a hostile capability
+	// claiming a very tall tree, or when content exceeds a given maximum.
+	ErrContentTooLarge = errors.New("content size overflows int64")
+	// ErrNonCanonicalPadding is returned by a Strict Decoder when the final
+	// content block is not padded exactly as Encode pads it.
+	ErrNonCanonicalPadding = errors.New("final content block padding is not canonical")
+	// ErrNonCanonicalTree is returned by a Strict Decoder when the tree is
+	// not shaped exactly as Encode shapes it.
+	ErrNonCanonicalTree = errors.New("tree shape is not canonical")
+	// ErrBlockLength is returned when a block written to be encoded is not
+	// exactly the block size.
+	ErrBlockLength = errors.New("block length does not match block size")
+	// ErrSecretTooLong is returned for a convergence secret longer than
+	// MaxSecretSize.
+	ErrSecretTooLong = errors.New("convergence secret is longer than 64 bytes")
+	// ErrMalformedInnerNode is returned when a decrypted inner node is not
+	// a valid sequence of reference-key pairs.
+	ErrMalformedInnerNode = errors.New("malformed inner node")
+	// ErrBlockTooShort is returned when a Storage returns fewer bytes than
+	// the block size, such as from a truncated transfer.
+	ErrBlockTooShort = errors.New("storage returned a block shorter than the block size")
+	// ErrBlockTooLong is returned when a Storage returns more bytes than the
+	// block size, such as from a framing bug mixing up adjacent blocks.
+	ErrBlockTooLong = errors.New("storage returned a block longer than the block size")
+	// ErrEmptyStorageResult is returned when a Storage returns no bytes and
+	// no error for a block, which is likely a bug in the Storage.
+	ErrEmptyStorageResult = errors.New("storage returned an empty block without an error")
 )
 
 type BlockSize int
@@ -44,30 +109,130 @@ type Ref struct {
 	Key       [KeySize]byte
 }
 
+var _ fmt.Stringer = Ref{}
+var _ encoding.BinaryMarshaler = Ref{}
+var _ encoding.BinaryUnmarshaler = new(Ref)
+
+// readCapabilitySize is the size of the binary read capability: one byte each
+// for the block size and level, followed by the reference and key.
+const readCapabilitySize = 2 + RefSize + KeySize
+
 func (r Ref) URN() (string, error) {
-	// Prepare read capability in binary form
+	// Prepare read capability in text form
+	enc, err := r.Encode(nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot create urn: %w", err)
+	}
+
+	// Create the URN
+	var b strings.Builder
+	b.WriteString("urn:")
+	b.WriteString(erisURNVersion)
+	b.WriteString(":")
+	b.WriteString(enc)
+	return b.String(), nil
+}
+
+// Encoding renders a binary read capability as text. Both *base32.Encoding
+// and *base64.Encoding implement it.
+type Encoding interface {
+	EncodeToString(src []byte) string
+}
+
+// urnEncoding is the unpadded base32 encoding of the read capability in a URN,
+// as mandated by the specification.
+var urnEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// HexEncoding renders the read capability as lowercase hexadecimal.
+var HexEncoding Encoding = hexEncoding{}
+
+// hexEncoding implements Encoding with encoding/hex.
+type hexEncoding struct{}
+
+func (hexEncoding) EncodeToString(src []byte) string {
+	return hex.EncodeToString(src)
+}
+
+// Encode renders the binary read capability with the Encoding, or with the
+// unpadded base32 of a URN if it is nil, without the URN prefix. Other encodings are not
+// part of the specification, and are meant for logging or for transports
+// that cannot carry base32, such as with base64.RawURLEncoding.
+func (r Ref) Encode(enc Encoding) (string, error) {
+	bb, err := r.ReadCapability()
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		return urnEncoding.EncodeToString(bb), nil
+	}
+	return enc.EncodeToString(bb), nil
+}
+
+// Equal determines whether both Refs are the same read capability. The
+// reference and key are compared in constant time.
+func (r Ref) Equal(other Ref) bool {
+	return r.BlockSize == other.BlockSize &&
+		r.Level == other.Level &&
+		subtle.ConstantTimeCompare(r.Ref[:], other.Ref[:]) == 1 &&
+		subtle.ConstantTimeCompare(r.Key[:], other.Key[:]) == 1
+}
+
+// String returns the URN of the Ref, or a short description of it if it
+// cannot be encoded as a URN.
+func (r Ref) String() string {
+	urn, err := r.URN()
+	if err != nil {
+		return fmt.Sprintf("erisref(level=%d, size=%d, %s)", r.Level, r.BlockSize, hex.EncodeToString(r.Ref[:8]))
+	}
+	return urn
+}
+
+// MarshalBinary encodes the Ref as the binary read capability.
+func (r Ref) MarshalBinary() ([]byte, error) {
+	return r.ReadCapability()
+}
+
+// ReadCapability returns the binary read capability of the Ref, which is the
+// form encoded as base32 within the URN. This permits callers to apply other
+// encodings to the read capability.
+//
+// The binary read capability is one byte for the block size, one byte for the
+// level, then the 32 byte reference followed by the 32 byte key.
+func (r Ref) ReadCapability() ([]byte, error) {
 	var bb bytes.Buffer
 	if r.BlockSize == Size1KiB {
 		bb.WriteByte(0)
 	} else if r.BlockSize == Size32KiB {
 		bb.WriteByte(1)
 	} else {
-		return "", errors.New("cannot create urn: unhandled block size")
+		return nil, ErrUnhandledBlockSize
 	}
-	if r.Level > math.MaxUint8 {
-		return "", errors.New("cannot create urn: level exceeds 1 byte depth")
+	if r.Level < 0 || r.Level > math.MaxUint8 {
+		return nil, ErrLevelTooLarge
 	}
 	bb.WriteByte(byte(r.Level))
 	bb.Write(r.Ref[:])
 	bb.Write(r.Key[:])
+	return bb.Bytes(), nil
+}
 
-	// Create the URN
-	var b strings.Builder
-	b.WriteString("urn:")
-	b.WriteString(erisURNVersion)
-	b.WriteString(":")
-	b.WriteString(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bb.Bytes()))
-	return b.String(), nil
+// UnmarshalBinary decodes the binary read capability into the Ref.
+func (r *Ref) UnmarshalBinary(b []byte) error {
+	if len(b) != readCapabilitySize {
+		return errors.New("binary read capability is not 66 bytes")
+	}
+	switch b[0] {
+	case 0:
+		r.BlockSize = Size1KiB
+	case 1:
+		r.BlockSize = Size32KiB
+	default:
+		return fmt.Errorf("binary read capability: %w", ErrUnhandledBlockSize)
+	}
+	r.Level = int(b[1])
+	copy(r.Ref[:], b[2:2+RefSize])
+	copy(r.Key[:], b[2+RefSize:])
+	return nil
 }
 
 // ebytes is an encrypted set of bytes
@@ -82,7 +247,7 @@ type ubytes []byte
 //
 // Returns the root reference block.
 func Encode1KiB(w WriteFunc, r io.Reader, secret []byte) (ref Ref, err error) {
-	return encode(w, r, secret, Size1KiB)
+	return Encode(w, r, secret, Size1KiB)
 }
 
 // Encode32KiB encodes bytes from the given Reader into 32 kibibyte blocks,
@@ -91,19 +256,220 @@ func Encode1KiB(w WriteFunc, r io.Reader, secret []byte) (ref Ref, err error) {
 //
 // Returns the root reference block.
 func Encode32KiB(w WriteFunc, r io.Reader, secret []byte) (ref Ref, err error) {
-	return encode(w, r, secret, Size32KiB)
+	return Encode(w, r, secret, Size32KiB)
 }
 
-// encode encodes bytes into a requested arbitrarily sized block.
+// Encode encodes bytes from the given Reader into blocks of the given size,
+// emitting the blocks to the WriteFunc as data is streamed in from the
+// Reader.
 //
-// Allocates a single buffer of block-size.
-func encode(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, err error) {
-	ref.BlockSize = size
+// The specification only defines 1 kibibyte and 32 kibibyte blocks, which are
+// the only sizes that may be represented in a URN. Other sizes are supported
+// for experimentation, so long as they are an even multiple of RefSize +
+// KeySize that holds at least two reference-key pairs.
+//
+// Returns the root reference block.
+func Encode(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, err error) {
+	if err = ValidBlockSize(size); err != nil {
+		return
+	}
+	return encode(context.Background(), w, r, secret, size)
+}
+
+// EncodeBytes encodes the in-memory data into blocks of the given size,
+// emitting the blocks to the WriteFunc.
+//
+// Only the block sizes defined by the specification are supported.
+//
+// Returns the root reference block.
+func EncodeBytes(w WriteFunc, data []byte, secret []byte, size BlockSize) (ref Ref, err error) {
+	if err = checkBlockSize(size); err != nil {
+		return
+	}
+	return encode(context.Background(), w, bytes.NewReader(data), secret, size)
+}
+
+// EncodeContext encodes bytes from the given Reader into blocks of the given
+// size like Encode, checking the context before encoding each block. If the
+// context is done, encoding is aborted and the context's error is returned.
+//
+// Returns the root reference block.
+func EncodeContext(ctx context.Context, w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, err error) {
+	if err = ValidBlockSize(size); err != nil {
+		return
+	}
+	return encode(ctx, w, r, secret, size)
+}
+
+// Encoder encodes content into blocks of a fixed size, emitting them to its
+// WriteFunc.
+//
+// An Encoder keeps the partially built tree between blocks, so it is not safe
+// for concurrent use: a shared Encoder would silently corrupt its trees. To
+// encode concurrently, use one Encoder per goroutine, which may share a Pool.
+type Encoder struct {
+	// Dedup enables skipping the WriteFunc for blocks this Encoder has
+	// already emitted. Since blocks are content-addressed, repeated content
+	// results in identical blocks that a content-addressed store need not
+	// write twice.
+	//
+	// Deduplicating requires remembering the reference of every emitted
+	// block, so memory grows with the number of unique blocks.
+	Dedup bool
+	// Workers is the number of goroutines hashing and encrypting content
+	// blocks concurrently. Values less than 2 encode serially.
+	//
+	// Reading content, building inner nodes, and calling the WriteFunc are
+	// still done in order, so the emitted blocks are identical to a serial
+	// encoding and the WriteFunc is never called concurrently.
+	Workers int
+	// Pool, if non-nil, supplies the content block buffers, which are
+	// returned to it once each call to Encode completes instead of being
+	// kept by the Encoder. Values in the Pool are []byte of any capacity; a
+	// short or missing one is replaced by a new allocation.
+	//
+	// Sharing a Pool avoids repeated allocations across many Encoders, or
+	// across the concurrent buffers of parallel encoding.
+	Pool *sync.Pool
+	// Hash, if non-nil, replaces the blake2b-256 hash functions used to
+	// derive read keys and references.
+	Hash HashProvider
+	// Cipher, if non-nil, replaces the chacha20 stream cipher used to
+	// encrypt blocks.
+	Cipher CipherProvider
+	// Padder, if non-nil, replaces the ISO/IEC 7816-4 padding of the final
+	// content block.
+	Padder Padder
+	// SecretKDF derives the key of the read key hash from the convergence
+	// secret with DeriveSecret, instead of using the secret itself.
+	//
+	// The specification keys the hash with the raw secret, which is right
+	// for a random secret of up to MaxSecretSize bytes shared with other
+	// ERIS implementations. A human passphrase is neither: it may be too
+	// long, and is better spread over the whole key. Only encodings with the
+	// same passphrase and SecretKDF setting produce the same blocks.
+	SecretKDF bool
+	// Set at construction or Reset
+	w      WriteFuncLevel
+	secret []byte
+	size   BlockSize
+	// mutable state
+	emitted map[[RefSize]byte]struct{}
+	// Buffers kept for reuse across calls to Encode
+	buf []byte
+	acc *accumulator
+	// Root of the most recent successful ReadFrom
+	root    Ref
+	hasRoot bool
+}
+
+var _ io.ReaderFrom = new(Encoder)
+
+// NewEncoder creates an Encoder emitting blocks of the given size to the
+// WriteFunc, using the optional convergence secret.
+func NewEncoder(w WriteFunc, secret []byte, size BlockSize) *Encoder {
+	return NewEncoderLevel(w.Leveled(), secret, size)
+}
+
+// NewEncoderLevel creates an Encoder like NewEncoder, emitting blocks along
+// with their level in the tree to the WriteFuncLevel.
+func NewEncoderLevel(w WriteFuncLevel, secret []byte, size BlockSize) *Encoder {
+	return &Encoder{
+		w:      w,
+		secret: secret,
+		size:   size,
+	}
+}
+
+// Reset prepares the Encoder to emit blocks of the given size to the
+// WriteFunc, using the optional convergence secret. The blocks remembered for
+// deduplication are forgotten.
+//
+// Buffers allocated by previous calls to Encode are reused when the block size
+// is unchanged, which avoids repeated allocations when encoding many objects.
+func (e *Encoder) Reset(w WriteFunc, secret []byte, size BlockSize) {
+	e.ResetLevel(w.Leveled(), secret, size)
+}
+
+// ResetLevel prepares the Encoder like Reset, emitting blocks along with their
+// level in the tree to the WriteFuncLevel.
+func (e *Encoder) ResetLevel(w WriteFuncLevel, secret []byte, size BlockSize) {
+	e.w = w
+	e.secret = secret
+	if e.size != size {
+		e.buf = nil
+		e.acc = nil
+	}
+	e.size = size
+	e.emitted = nil
+	e.hasRoot = false
+}
+
+// Encode encodes bytes from the given Reader, emitting the blocks to the
+// Encoder's WriteFunc.
+//
+// Returns the root reference block.
+func (e *Encoder) Encode(r io.Reader) (ref Ref, err error) {
+	if err = ValidBlockSize(e.size); err != nil {
+		return
+	}
+	return e.encode(context.Background(), r)
+}
+
+// ReadFrom encodes bytes from the given Reader like Encode, returning the
+// number of content bytes read, which excludes padding. This implements
+// io.ReaderFrom, for composing with code that pipes into one.
+//
+// The root reference is kept for Root, and is only valid after a successful
+// call to ReadFrom.
+func (e *Encoder) ReadFrom(r io.Reader) (n int64, err error) {
+	e.hasRoot = false
+	cr := &countingReader{r: r}
+	var root Ref
+	root, err = e.Encode(cr)
+	n = cr.n
+	if err != nil {
+		return
+	}
+	e.root = root
+	e.hasRoot = true
+	return
+}
+
+// Root returns the root reference of the content encoded by the most recent
+// call to ReadFrom, or an error if that call failed or there has not been one
+// since the Encoder was created or Reset.
+func (e *Encoder) Root() (Ref, error) {
+	if !e.hasRoot {
+		return Ref{}, errors.New("encoder has no root: ReadFrom has not succeeded")
+	}
+	return e.root, nil
+}
+
+// encode encodes bytes into blocks of the Encoder's size, until either the
+// Reader is exhausted or the context is done.
+//
+// Allocates a single buffer of block-size, unless one is available from a
+// previous call.
+func (e *Encoder) encode(ctx context.Context, r io.Reader) (ref Ref, err error) {
+	if e.Workers > 1 {
+		return e.encodeParallel(ctx, r)
+	}
+	ref.BlockSize = e.size
 	var mFn marshalFn
-	var acc *accumulator
-	mFn, acc, err = newMarshaller(w, secret, size)
-	buf := make([]byte, size)
+	mFn, err = e.prepare()
+	if err != nil {
+		return
+	}
+	buf := e.buf
+	if e.Pool != nil {
+		buf = getPoolBuf(e.Pool, e.size)
+		defer putPoolBuf(e.Pool, buf)
+	}
 	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		var n int
 		n, err = io.ReadFull(r, buf)
 		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
@@ -111,12 +477,19 @@ func encode(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, e
 			return
 		} else if n == 0 && err == io.EOF || // Do special closing padding block, then terminate; or...
 			err == io.ErrUnexpectedEOF { // ...pad current block, then terminate.
-			buf = padContentBlock(buf[:n], size)
-			err = mFn(buf)
+			buf, err = e.prims().pad(buf[:n], e.size)
 			if err != nil {
 				return
 			}
-			ref, err = acc.Flush()
+			// Padding a full block results in two blocks, which must be
+			// marshalled separately.
+			for off := 0; off < len(buf); off += int(e.size) {
+				err = mFn(buf[off : off+int(e.size)])
+				if err != nil {
+					return
+				}
+			}
+			ref, err = e.acc.Flush()
 			return
 		} else {
 			// Process block normally.
@@ -128,14 +501,250 @@ func encode(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, e
 	}
 }
 
+// prepare readies the block buffer and accumulators for a new encoding,
+// reusing those of a previous encoding if possible. The block buffer is left
+// to be taken from the Pool, if there is one, or to the parallel workers.
+func (e *Encoder) prepare() (marshalFn, error) {
+	p := e.prims()
+	w := e.writeFunc()
+	if e.Pool == nil && e.Workers <= 1 && len(e.buf) != int(e.size) {
+		e.buf = make([]byte, e.size)
+	}
+	if e.acc == nil {
+		mFn, acc, err := newMarshaller(p, w, e.key(), e.size)
+		if err != nil {
+			return nil, err
+		}
+		e.acc = acc
+		return mFn, nil
+	}
+	secret := e.key()
+	e.acc.retire(p, w, secret)
+	return recurMarshalBlocks(p, w, secret, 0, e.acc.RecurAccumulate), nil
+}
+
+// key determines the key of the read key hash from the convergence secret.
+func (e *Encoder) key() []byte {
+	if e.SecretKDF {
+		k := DeriveSecret(e.secret)
+		return k[:]
+	}
+	return e.secret
+}
+
+// prims determines the primitives blocks are encoded with.
+func (e *Encoder) prims() primitives {
+	return primitives{hash: e.Hash, cipher: e.Cipher, padder: e.Padder}
+}
+
+// writeFunc determines the WriteFunc blocks are emitted to.
+func (e *Encoder) writeFunc() WriteFuncLevel {
+	if e.Dedup {
+		return e.dedupWrite
+	}
+	return e.w
+}
+
+// dedupWrite calls the Encoder's WriteFunc only for blocks not yet emitted.
+func (e *Encoder) dedupWrite(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte, level int) error {
+	if e.emitted == nil {
+		e.emitted = make(map[[RefSize]byte]struct{})
+	}
+	if _, ok := e.emitted[ref]; ok {
+		return nil
+	}
+	if err := e.w(eblock, ref, readkey, level); err != nil {
+		return err
+	}
+	e.emitted[ref] = struct{}{}
+	return nil
+}
+
+// BlockEncoder encodes content pushed to it one block at a time, emitting the
+// blocks to its WriteFunc as they are written. It is the push counterpart to
+// an Encoder reading from an io.Reader, for callers that already have their
+// content chunked into blocks or that interleave encoding with other work.
+//
+// Every written block is content, and Finish appends the final padding
+// block, so the root reference is the same as encoding the concatenation of
+// the written blocks with Encode. Content whose length is not a multiple of
+// the block size should be encoded with an Encoder instead.
+type BlockEncoder struct {
+	size BlockSize
+	mFn  marshalFn
+	acc  *accumulator
+	buf  []byte
+	done bool
+}
+
+// NewBlockEncoder creates a BlockEncoder emitting blocks of the given size to
+// the WriteFunc, using the optional convergence secret.
+func NewBlockEncoder(w WriteFunc, secret []byte, size BlockSize) (*BlockEncoder, error) {
+	if err := ValidBlockSize(size); err != nil {
+		return nil, err
+	}
+	mFn, acc, err := newMarshaller(primitives{}, w.Leveled(), secret, size)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockEncoder{
+		size: size,
+		mFn:  mFn,
+		acc:  acc,
+		buf:  make([]byte, size),
+	}, nil
+}
+
+// WriteBlock encodes the content block, which must be exactly the block size,
+// emitting it and any completed inner nodes to the WriteFunc.
+//
+// A block of any other length is rejected with ErrBlockLength before anything
+// is encoded, so the BlockEncoder may continue to be used. The block is
+// copied, so the caller may reuse it once WriteBlock returns.
+func (b *BlockEncoder) WriteBlock(ublock []byte) error {
+	if b.done {
+		return errors.New("block encoder is finished")
+	} else if len(ublock) != int(b.size) {
+		return fmt.Errorf("content block of %d bytes: %w", len(ublock), ErrBlockLength)
+	}
+	copy(b.buf, ublock)
+	return b.mFn(b.buf)
+}
+
+// Finish emits the final padding block and the remaining inner nodes,
+// returning the root reference. No further blocks may be written.
+func (b *BlockEncoder) Finish() (ref Ref, err error) {
+	if b.done {
+		err = errors.New("block encoder is finished")
+		return
+	}
+	b.done = true
+	if err = b.mFn(padContentBlock(b.buf[:0], b.size)); err != nil {
+		return
+	}
+	return b.acc.Flush()
+}
+
+// Stats describes the blocks emitted while encoding.
+type Stats struct {
+	// Number of blocks emitted, which is the sum of ContentBlocks and
+	// InnerBlocks.
+	Blocks int
+	// Number of content blocks emitted, including the final padded block.
+	ContentBlocks int
+	// Number of inner nodes emitted, including the root node if the tree has
+	// more than one content block.
+	InnerBlocks int
+	// Depth of the tree, which is the level of the root reference.
+	Depth int
+	// Number of content bytes read, excluding padding.
+	BytesRead int64
+}
+
+// EncodeStats encodes bytes from the given Reader into blocks of the given
+// size like Encode, additionally returning statistics about the emitted
+// blocks.
+//
+// Returns the root reference block.
+func EncodeStats(w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, st Stats, err error) {
+	if err = ValidBlockSize(size); err != nil {
+		return
+	}
+	cw := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte, level int) error {
+		st.Blocks++
+		if level == 0 {
+			st.ContentBlocks++
+		} else {
+			st.InnerBlocks++
+		}
+		return w(eblock, ref, readkey)
+	}
+	cr := &countingReader{r: r}
+	ref, err = NewEncoderLevel(cw, secret, size).encode(context.Background(), cr)
+	if err != nil {
+		return
+	}
+	st.Depth = ref.Level
+	st.BytesRead = cr.n
+	return
+}
+
+// countingReader counts the bytes read from the underlying Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying Reader, counting the bytes read.
+func (c *countingReader) Read(b []byte) (n int, err error) {
+	n, err = c.r.Read(b)
+	c.n += int64(n)
+	return
+}
+
+// ValidBlockSize checks that content may be encoded into blocks of the given
+// size, which every function encoding content checks before encoding. A block
+// size holding fewer than two reference-key pairs cannot build a tree, and is
+// rejected with ErrBlockSizeTooSmall. A block size that is not an even
+// multiple of RefSize + KeySize is rejected with ErrBlockSizeMultiple.
+//
+// A valid block size need not be one defined by the specification: only 1KiB
+// and 32KiB blocks may be decoded or represented in a URN.
+func ValidBlockSize(size BlockSize) error {
+	if size < 2*(RefSize+KeySize) {
+		return ErrBlockSizeTooSmall
+	} else if size%(RefSize+KeySize) != 0 {
+		return ErrBlockSizeMultiple
+	}
+	return nil
+}
+
+// EncodeSingleBlock encodes the content into exactly one block, emitting it to
+// the WriteFunc and returning its level 0 reference.
+//
+// Returns an error if the content does not fit into a single block. Since the
+// content is always padded with at least one byte, the content must be smaller
+// than the block size.
+func EncodeSingleBlock(w WriteFunc, content []byte, secret []byte, size BlockSize) (ref Ref, err error) {
+	if err = checkBlockSize(size); err != nil {
+		return
+	}
+	if len(content) >= int(size) {
+		err = errors.New("content does not fit into a single padded block")
+		return
+	}
+	buf := make([]byte, len(content), size)
+	copy(buf, content)
+	buf = padContentBlock(buf, size)
+	eblock, r, k, err := marshalBlock(buf, secret)
+	if err != nil {
+		return
+	}
+	err = w(eblock, r, k)
+	if err != nil {
+		return
+	}
+	ref.BlockSize = size
+	ref.Level = 0
+	ref.Ref = r
+	ref.Key = k
+	return
+}
+
+// encode encodes bytes into a requested arbitrarily sized block, until either
+// the Reader is exhausted or the context is done, using a throwaway Encoder.
+func encode(ctx context.Context, w WriteFunc, r io.Reader, secret []byte, size BlockSize) (ref Ref, err error) {
+	return NewEncoder(w, secret, size).encode(ctx, r)
+}
+
 // TL;DR: Strategy is to build the tree up recursively, growing in log-space
 // memory requirements during single pass encoding.
-func newMarshaller(w WriteFunc, secret []byte, size BlockSize) (marshalFn, *accumulator, error) {
-	acc, err := newAccumulator(w, size, secret, 1, nil)
+func newMarshaller(p primitives, w WriteFuncLevel, secret []byte, size BlockSize) (marshalFn, *accumulator, error) {
+	acc, err := newAccumulator(p, w, size, secret, 1, nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	m := recurMarshalBlocks(w, secret, acc.RecurAccumulate)
+	m := recurMarshalBlocks(p, w, secret, 0, acc.RecurAccumulate)
 	return m, acc, nil
 }
 
@@ -143,6 +752,19 @@ type accumFn func(r [RefSize]byte, k [KeySize]byte) error
 type marshalFn func(ublock ubytes) error
 type WriteFunc func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error
 
+// WriteFuncLevel is a WriteFunc that is also told the level of each block in
+// the tree, where level 0 is a content block and higher levels are inner
+// nodes. This permits storing inner nodes and content blocks differently, such
+// as keeping the inner nodes in a faster tier.
+type WriteFuncLevel func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte, level int) error
+
+// Leveled adapts the WriteFunc into a WriteFuncLevel that ignores the level.
+func (w WriteFunc) Leveled() WriteFuncLevel {
+	return func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte, level int) error {
+		return w(eblock, ref, readkey)
+	}
+}
+
 // accumulator is responsible for accumulating references to blocks in a layer
 // below this accumulator. The accumulator is responsible for the recursive
 // construction of a tree bottom-up. A single accumulator instance's lifetime
@@ -151,26 +773,31 @@ type WriteFunc func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) err
 //
 // Each accumulator allocates a single buffer of block-size.
 type accumulator struct {
-	W      WriteFunc
+	Prims  primitives
+	W      WriteFuncLevel
 	Size   BlockSize
 	Level  int
 	Secret []byte
 	// Set non-nil-once state
 	Parent        *accumulator
 	ParentMarshal marshalFn
-	// mutable state
+	// mutable state. Only the first N bytes of RefKeyPairs are meaningful,
+	// the rest is stale until zeroed by pad.
 	RefKeyPairs []byte
 	N           int
+	// Detached parent available for reuse
+	spare *accumulator
 }
 
 // newAccumulator creates a new accumulator with a properly-sized buffer.
 //
-// Enforces that the requested size is evenly divisible by RefSize + KeySize.
-func newAccumulator(w WriteFunc, size BlockSize, secret []byte, level int, parent *accumulator) (*accumulator, error) {
-	if size%(RefSize+KeySize) != 0 {
-		return nil, errors.New("requested block size is not an even multiple of reference-key pair size")
+// Enforces that the requested size is a valid block size.
+func newAccumulator(p primitives, w WriteFuncLevel, size BlockSize, secret []byte, level int, parent *accumulator) (*accumulator, error) {
+	if err := ValidBlockSize(size); err != nil {
+		return nil, err
 	}
 	return &accumulator{
+		Prims:       p,
 		W:           w,
 		Size:        size,
 		Level:       level,
@@ -181,14 +808,43 @@ func newAccumulator(w WriteFunc, size BlockSize, secret []byte, level int, paren
 	}, nil
 }
 
-// reset the buffer and index.
+// reset the index, so that the buffer is overwritten by the following pairs.
+//
+// The buffer is not zeroed: add writes sequentially, so a full inner node
+// never holds stale bytes, and pad zeroes the tail of a partial one before it
+// is marshalled.
 func (a *accumulator) reset() {
-	for i := 0; i < len(a.RefKeyPairs); i++ {
-		a.RefKeyPairs[i] = 0
-	}
 	a.N = 0
 }
 
+// pad zeroes the buffer following the accumulated pairs, which are the
+// all-zero reference-key pairs padding a partial inner node.
+func (a *accumulator) pad() {
+	// The compiler lowers this form of loop to a single memory clear.
+	tail := a.RefKeyPairs[a.N:]
+	for i := range tail {
+		tail[i] = 0
+	}
+}
+
+// retire resets this accumulator and every one above it, detaching them so
+// that they may be reused for a new tree. The detached parent is kept as a
+// spare, to be reattached when the new tree grows to need it.
+func (a *accumulator) retire(p primitives, w WriteFuncLevel, secret []byte) {
+	a.reset()
+	a.Prims = p
+	a.W = w
+	a.Secret = secret
+	a.ParentMarshal = nil
+	if a.Parent != nil {
+		a.Parent.retire(p, w, secret)
+		a.spare = a.Parent
+		a.Parent = nil
+	} else if a.spare != nil {
+		a.spare.retire(p, w, secret)
+	}
+}
+
 // add the reference and key pair to the buffer, incrementing the index as
 // needed.
 func (a *accumulator) add(ref [RefSize]byte, key [KeySize]byte) {
@@ -210,14 +866,24 @@ func (a *accumulator) RecurAccumulate(ref [RefSize]byte, key [KeySize]byte) erro
 		// to fit the new data.
 		//
 		// If there is no Parent layer to marshal our new block's
-		// reference-key pair into, create the above layer.
+		// reference-key pair into, create the above layer. A level that
+		// cannot be represented in a read capability fails the encoding
+		// now, rather than once the whole content has been encoded.
 		if a.Parent == nil {
-			var err error
-			a.Parent, err = newAccumulator(a.W, a.Size, a.Secret, a.Level+1, nil)
-			if err != nil {
-				return err
+			if a.Level+1 > math.MaxUint8 {
+				return ErrLevelTooLarge
+			}
+			if a.spare != nil {
+				a.Parent = a.spare
+				a.spare = nil
+			} else {
+				var err error
+				a.Parent, err = newAccumulator(a.Prims, a.W, a.Size, a.Secret, a.Level+1, nil)
+				if err != nil {
+					return err
+				}
 			}
-			a.ParentMarshal = recurMarshalBlocks(a.W, a.Secret, a.Parent.RecurAccumulate)
+			a.ParentMarshal = recurMarshalBlocks(a.Prims, a.W, a.Secret, a.Level, a.Parent.RecurAccumulate)
 		}
 		// Accumulate current references to parent
 		err := a.ParentMarshal(a.RefKeyPairs)
@@ -259,7 +925,8 @@ func (a *accumulator) Flush() (root Ref, err error) {
 			copy(root.Key[:], key[:])
 			return nil
 		}
-		a.ParentMarshal = recurMarshalBlocks(a.W, a.Secret, cls)
+		a.ParentMarshal = recurMarshalBlocks(a.Prims, a.W, a.Secret, a.Level, cls)
+		a.pad()
 		err = a.ParentMarshal(a.RefKeyPairs)
 		return
 	} else {
@@ -267,6 +934,7 @@ func (a *accumulator) Flush() (root Ref, err error) {
 		//
 		// Assume the buffer is never empty -- flush it to a new block
 		// for the parent to then handle as a final reference-key pair.
+		a.pad()
 		err = a.ParentMarshal(a.RefKeyPairs)
 		if err != nil {
 			return
@@ -276,15 +944,15 @@ func (a *accumulator) Flush() (root Ref, err error) {
 }
 
 // recurMarshalBlocks is a closure that allows calling the same accumFn for
-// multiple invocations, and emitting the block once it has been marshalled.
-// This allows a streaming emission of the blocks.
-func recurMarshalBlocks(w WriteFunc, secret []byte, accFn accumFn) marshalFn {
+// multiple invocations, and emitting the block at the given level once it has
+// been marshalled. This allows a streaming emission of the blocks.
+func recurMarshalBlocks(p primitives, w WriteFuncLevel, secret []byte, level int, accFn accumFn) marshalFn {
 	return func(ublock ubytes) error {
-		eblock, ref, readKey, err := marshalBlock(ublock, secret)
+		eblock, ref, readKey, err := p.marshalBlock(ublock, secret)
 		if err != nil {
 			return err
 		}
-		err = w(eblock, ref, readKey)
+		err = w(eblock, ref, readKey, level)
 		if err != nil {
 			return err
 		}
@@ -297,18 +965,23 @@ func recurMarshalBlocks(w WriteFunc, secret []byte, accFn accumFn) marshalFn {
 //
 // The secret is allowed to be nil.
 func marshalBlock(ublock ubytes, secret []byte) (eblock ebytes, ref [RefSize]byte, readKey [KeySize]byte, err error) {
+	return primitives{}.marshalBlock(ublock, secret)
+}
+
+// marshalBlock implements marshalBlock using the primitives.
+func (p primitives) marshalBlock(ublock ubytes, secret []byte) (eblock ebytes, ref [RefSize]byte, readKey [KeySize]byte, err error) {
 	// Get Read Key
-	readKey, err = toReadKey(ublock, secret)
+	readKey, err = p.toReadKey(ublock, secret)
 	if err != nil {
 		return
 	}
 	// Encrypt
-	eblock, err = encrypt(ublock, readKey)
+	eblock, err = p.encryptTo(ublock, ublock, readKey)
 	if err != nil {
 		return
 	}
 	// Get Reference
-	ref = toRef(eblock)
+	ref = p.toRef(eblock)
 	return
 }
 
@@ -326,14 +999,45 @@ func marshalBlock(ublock ubytes, secret []byte) (eblock ebytes, ref [RefSize]byt
 // If the length of the last content block is exactly block size, then padding
 // will result in a padded block that is double the block size and must be
 // split.
+//
+// The padding is written in-place when the block has the capacity for it, as
+// it does when padding the last partial block of an encoding. Only a block
+// without spare capacity, such as one exactly block size long, is grown.
 func padContentBlock(block ubytes, size BlockSize) ubytes {
 	n := int(size) - len(block)%int(size)
-	if n == 0 {
-		n = int(size)
+	l := len(block)
+	if cap(block)-l < n {
+		block = append(block, make([]byte, n)...)
 	}
-	p := make([]byte, n) // TODO: Remove this allocation
-	pad(p)
-	return append(block, p...)
+	block = block[:l+n]
+	pad(block[l:])
+	return block
+}
+
+// ReadKey computes the read key of the unencrypted block with the optional
+// convergence secret, as the key it is encrypted with when encoded.
+func ReadKey(ublock []byte, secret []byte) ([KeySize]byte, error) {
+	return toReadKey(ublock, secret)
+}
+
+// BlockRef computes the reference of the encrypted block, such as to confirm
+// that a block being stored matches its reference.
+func BlockRef(eblock []byte) [RefSize]byte {
+	return toRef(eblock)
+}
+
+// DeriveSecret derives a 32 byte convergence secret from a passphrase of any
+// length, as done by an Encoder with SecretKDF set. The passphrase is hashed
+// with blake2b-256 keyed by a fixed label, so that the derived secret differs
+// from a plain hash of the passphrase.
+//
+// The derived secret may be passed wherever a convergence secret is taken,
+// such as to Encode, to encode like an Encoder with SecretKDF set.
+func DeriveSecret(passphrase []byte) (secret [32]byte) {
+	h, _ := blake2b.New256([]byte(secretKDFLabel))
+	h.Write(passphrase)
+	h.Sum(secret[:0])
+	return
 }
 
 // toReadKey computes a read symmetric key with an optional secret, which may be
@@ -346,8 +1050,13 @@ func padContentBlock(block ubytes, size BlockSize) ubytes {
 // the convergence secret MUST be used as key of the hash function. The output
 // of the hash is the key.
 func toReadKey(block ubytes, secret []byte) (rk [KeySize]byte, err error) {
+	return primitives{}.toReadKey(block, secret)
+}
+
+// toReadKey implements toReadKey using the primitives.
+func (p primitives) toReadKey(block ubytes, secret []byte) (rk [KeySize]byte, err error) {
 	var h hash.Hash
-	h, err = newCryptoHash(secret)
+	h, err = p.hashProvider().NewKeyedHash(secret)
 	if err != nil {
 		return
 	}
@@ -368,20 +1077,38 @@ func toReadKey(block ubytes, secret []byte) (rk [KeySize]byte, err error) {
 	return
 }
 
-// encrypt implements the encryption algorithm for a large chunk of plaintext.
+// encrypt implements the encryption algorithm for a large chunk of plaintext,
+// encrypting in-place so that the plaintext block is overwritten by the
+// encrypted one. This avoids a copy when the caller exclusively owns the
+// block.
 //
 // From 0.2 documentation:
 //
 // 2.
 // Encrypt the block using the symmetric key cipher with the key.
 func encrypt(block ubytes, key [KeySize]byte) (ebytes, error) {
-	c, err := newSymmKeyCipher(key)
+	return encryptTo(ebytes(block), block, key)
+}
+
+// encryptTo encrypts the plaintext block into the destination, which must be
+// at least as long, returning the encrypted subslice of it. The plaintext is
+// left unmodified unless it is also the destination.
+func encryptTo(dst []byte, src ubytes, key [KeySize]byte) (ebytes, error) {
+	return primitives{}.encryptTo(dst, src, key)
+}
+
+// encryptTo implements encryptTo using the primitives.
+func (p primitives) encryptTo(dst []byte, src ubytes, key [KeySize]byte) (ebytes, error) {
+	if len(dst) < len(src) {
+		return nil, errors.New("encryption destination shorter than block")
+	}
+	c, err := p.cipherProvider().NewStream(key)
 	if err != nil {
 		return nil, err
 	}
-	// Encrypt in-place
-	c.XORKeyStream(block[:], block)
-	return ebytes(block), nil
+	dst = dst[:len(src)]
+	c.XORKeyStream(dst, src)
+	return ebytes(dst), nil
 }
 
 // toRef determines the block reference for a block
@@ -391,12 +1118,151 @@ func encrypt(block ubytes, key [KeySize]byte) (ebytes, error) {
 // 3.
 // The hash of the encrypted block is used as reference to the encrypted block.
 func toRef(b ebytes) [RefSize]byte {
-	return newRefHash(b)
+	return primitives{}.toRef(b)
+}
+
+// toRef implements toRef using the primitives.
+func (p primitives) toRef(b ebytes) [RefSize]byte {
+	return p.hashProvider().RefHash(b)
+}
+
+// HashProvider supplies the hash functions deriving the read key and the
+// reference of each block, which are blake2b-256 by default.
+//
+// It is a seam for testing alternative primitives. Blocks encoded with any
+// other HashProvider cannot be decoded by other ERIS implementations, even
+// though their URNs use the same version string.
+type HashProvider interface {
+	// NewKeyedHash returns a new hash for deriving the read key of an
+	// unencrypted block, keyed by the convergence secret which may be nil.
+	// The hash must produce KeySize bytes.
+	NewKeyedHash(secret []byte) (hash.Hash, error)
+	// RefHash computes the reference of an encrypted block.
+	RefHash(eblock []byte) [RefSize]byte
+}
+
+var _ HashProvider = Blake2b{}
+
+// Blake2b is the HashProvider specified by ERIS, and the default one.
+type Blake2b struct{}
+
+// NewKeyedHash returns a new blake2b-256 hash keyed by the secret, which must
+// be no longer than MaxSecretSize. A nil secret is the same as an empty one.
+func (Blake2b) NewKeyedHash(secret []byte) (hash.Hash, error) {
+	return newCryptoHash(secret)
+}
+
+// RefHash computes the unkeyed blake2b-256 hash of the encrypted block.
+func (Blake2b) RefHash(eblock []byte) [RefSize]byte {
+	return newRefHash(eblock)
+}
+
+// CipherProvider supplies the stream cipher that blocks are encrypted and
+// decrypted with, which is chacha20 with a zero nonce by default.
+//
+// Like HashProvider, it is a seam for testing alternative primitives, and
+// blocks encrypted with any other CipherProvider cannot be decoded by other
+// ERIS implementations.
+type CipherProvider interface {
+	// NewStream returns a new stream cipher keyed by the read key of a
+	// block. Since every block has a unique key, no nonce is needed.
+	NewStream(key [KeySize]byte) (cipher.Stream, error)
+}
+
+var _ CipherProvider = ChaCha20{}
+
+// ChaCha20 is the CipherProvider specified by ERIS, and the default one.
+type ChaCha20 struct{}
+
+// NewStream returns a new chacha20 stream with a zero nonce.
+func (ChaCha20) NewStream(key [KeySize]byte) (cipher.Stream, error) {
+	return newSymmKeyCipher(key)
+}
+
+// Padder pads the final content block to the block size, and strips the
+// padding once it is decoded. The default is ISO/IEC 7816-4 padding.
+//
+// Like HashProvider, it is a seam for conformance testing against other
+// implementations or revisions of the specification, and blocks padded by
+// any other Padder cannot be decoded by other ERIS implementations.
+type Padder interface {
+	// Pad pads the content of the final content block, which is shorter
+	// than the block size, returning the padded blocks. Their length must
+	// be a positive multiple of the block size. The content may be padded
+	// in place when it has the capacity.
+	Pad(buf []byte, size BlockSize) []byte
+	// Unpad returns the content of the final content block preceding its
+	// padding, or an error if the block is not properly padded.
+	Unpad(buf []byte) ([]byte, error)
+}
+
+var _ Padder = ISO7816{}
+
+// ISO7816 is the Padder specified by ERIS, and the default one. It pads with a
+// 0x80 byte followed by zero bytes.
+type ISO7816 struct{}
+
+// Pad pads the content with ISO/IEC 7816-4 padding to the next multiple of the
+// block size.
+func (ISO7816) Pad(buf []byte, size BlockSize) []byte {
+	return padContentBlock(buf, size)
+}
+
+// Unpad strips the ISO/IEC 7816-4 padding from the block like the package-level
+// Unpad.
+func (ISO7816) Unpad(buf []byte) ([]byte, error) {
+	return unpad(buf)
+}
+
+// primitives are the cryptographic primitives used to encode and decode
+// blocks, and the padding of the final content block. The zero value uses
+// those specified by ERIS.
+type primitives struct {
+	hash   HashProvider
+	cipher CipherProvider
+	padder Padder
+}
+
+// padProvider returns the Padder, or the default one.
+func (p primitives) padProvider() Padder {
+	if p.padder == nil {
+		return ISO7816{}
+	}
+	return p.padder
+}
+
+// pad pads the final content block with the Padder, checking that it results
+// in whole blocks.
+func (p primitives) pad(block ubytes, size BlockSize) (ubytes, error) {
+	b := p.padProvider().Pad(block, size)
+	if len(b) == 0 || len(b)%int(size) != 0 {
+		return nil, fmt.Errorf("padded final block of %d bytes: %w", len(b), ErrBlockLength)
+	}
+	return b, nil
+}
+
+// cipherProvider returns the CipherProvider, or the default one.
+func (p primitives) cipherProvider() CipherProvider {
+	if p.cipher == nil {
+		return ChaCha20{}
+	}
+	return p.cipher
+}
+
+// hashProvider returns the HashProvider, or the default one.
+func (p primitives) hashProvider() HashProvider {
+	if p.hash == nil {
+		return Blake2b{}
+	}
+	return p.hash
 }
 
 /* Specific crypto & implementation dependencies. */
 
 func newCryptoHash(key []byte) (hash.Hash, error) {
+	if len(key) > MaxSecretSize {
+		return nil, ErrSecretTooLong
+	}
 	return blake2b.New256(key)
 }
 
@@ -409,6 +1275,13 @@ func newSymmKeyCipher(key [KeySize]byte) (cipher.Stream, error) {
 	return chacha20.NewUnauthenticatedCipher(key[:], zNonce)
 }
 
+// Pad overwrites the whole buffer with ISO/IEC 7816-4 padding: a 0x80 byte
+// followed by zero bytes. ERIS pads the final content block by calling Pad on
+// the remainder of the block following the content, which is never empty.
+func Pad(buf []byte) {
+	pad(buf)
+}
+
 func pad(b []byte) {
 	// ISO/IEC 7816-4
 	if len(b) > 0 {
@@ -0,0 +1,101 @@
+package eris
+
+import (
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ BlockStore = new(FSStorage)
+var _ WriteFunc = new(FSStorage).WriteFunc
+
+// FSStorage is a Storage of encrypted blocks as files within a directory.
+//
+// Each block is stored in a file named after the unpadded base32 encoding of
+// its reference. To avoid a single enormous flat directory, files are sharded
+// into subdirectories named after the first two characters of their name. For
+// example, the block with reference "ABCD..." is stored at "<dir>/AB/ABCD...".
+//
+// Blocks are written atomically, by writing to a temporary file in the shard
+// directory before renaming it into place.
+type FSStorage struct {
+	dir string
+}
+
+// NewFSStorage creates a FSStorage rooted at the directory, creating it if it
+// does not already exist.
+func NewFSStorage(dir string) (*FSStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FSStorage{dir: dir}, nil
+}
+
+// Get reads the block with the reference from its file. Returns an error
+// wrapping ErrBlockNotFound if there is no such file.
+func (f *FSStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	b, err := ioutil.ReadFile(f.path(ref))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("fs storage ref=%s: %w",
+			base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:]), ErrBlockNotFound)
+	}
+	return b, err
+}
+
+// Put atomically writes the encrypted block to the file for its reference.
+// Blocks already present are not rewritten. Like MemStorage.Put, a block that
+// does not hash to the reference is rejected with a RefMismatchError.
+func (f *FSStorage) Put(eblock []byte, ref [RefSize]byte) error {
+	if err := checkPutRef(eblock, ref); err != nil {
+		return err
+	}
+	return f.put(eblock, ref)
+}
+
+// WriteFunc atomically writes the encrypted block to its file, and matches the
+// WriteFunc signature so that it may be passed to an encoder.
+func (f *FSStorage) WriteFunc(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+	return f.put(eblock, ref)
+}
+
+// put atomically writes the encrypted block to the file for the reference.
+func (f *FSStorage) put(eblock []byte, ref [RefSize]byte) error {
+	p := f.path(ref)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	shard := filepath.Dir(p)
+	if err := os.MkdirAll(shard, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(shard, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(eblock)
+	if err == nil {
+		// Temporary files are only readable by their owner, unlike the
+		// shard directories, so that a block server may read the blocks.
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// path determines the sharded file path for the reference.
+func (f *FSStorage) path(ref [RefSize]byte) string {
+	name := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+	return filepath.Join(f.dir, name[:2], name)
+}
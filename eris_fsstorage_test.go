@@ -0,0 +1,60 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFSStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blocks")
+	f, err := NewFSStorage(dir)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	content := testContent(40*int(Size1KiB) + 100)
+	root, err := Encode1KiB(f.WriteFunc, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var buf bytes.Buffer
+	if err = Decode(f, &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// The root block lands in its shard directory, readable by others.
+	name := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(root.Ref[:])
+	if fi, err := os.Stat(filepath.Join(dir, name[:2], name)); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if fi.Mode().Perm() != 0644 {
+		t.Errorf("got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0644))
+	}
+	// Putting an existing block is a no-op.
+	eb, err := f.Get(root.Ref)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if err = f.Put(eb, root.Ref); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	// A block is not stored under another reference.
+	if err = f.Put(eb, [RefSize]byte{1}); !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("got %v, want %v", err, ErrRefMismatch)
+	} else if _, err = f.Get([RefSize]byte{1}); err == nil {
+		t.Errorf("got %v, want error for missing ref", err)
+	}
+	if _, err = f.Get([RefSize]byte{}); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBlockNotFound)
+	}
+	// A file that cannot be read is not a missing block.
+	if err = os.MkdirAll(f.path([RefSize]byte{2}), 0755); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if _, err = f.Get([RefSize]byte{2}); err == nil || errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want an error not wrapping %v", err, ErrBlockNotFound)
+	}
+}
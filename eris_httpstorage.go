@@ -0,0 +1,84 @@
+package eris
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var _ Storage = new(HTTPStorage)
+var _ StorageContext = new(HTTPStorage)
+
+// maxHTTPBlockSize bounds the bytes read from a single response, as no block
+// may be decoded that exceeds the largest supported block size.
+const maxHTTPBlockSize = int64(Size32KiB)
+
+// HTTPStorage is a Storage that fetches blocks from a remote ERIS block server.
+//
+// A block is fetched by issuing a GET request to the base URL joined with the
+// unpadded base32 encoding of the block's reference. Only the response length
+// is checked, leaving the verification of the block's contents to the
+// decoder.
+type HTTPStorage struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPStorage creates a HTTPStorage fetching blocks beneath the base URL.
+// If the client is nil, http.DefaultClient is used.
+func NewHTTPStorage(baseURL string, client *http.Client) *HTTPStorage {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPStorage{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+	}
+}
+
+// Get fetches the block with the reference from the block server.
+func (h *HTTPStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	return h.GetContext(context.Background(), ref)
+}
+
+// GetContext fetches the block with the reference from the block server,
+// cancelling the request when the context is done.
+//
+// Returns an error wrapping ErrBlockNotFound when the server responds with 404
+// Not Found.
+func (h *HTTPStorage) GetContext(ctx context.Context, ref [RefSize]byte) ([]byte, error) {
+	sref := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+	req, err := http.NewRequest(http.MethodGet, h.baseURL+"/"+sref, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("http storage ref=%s: %w", sref, ErrBlockNotFound)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http storage ref=%s: unexpected status %s", sref, resp.Status)
+	}
+	if resp.ContentLength > maxHTTPBlockSize {
+		return nil, fmt.Errorf("http storage ref=%s: response of %d bytes exceeds maximum block size", sref, resp.ContentLength)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxHTTPBlockSize {
+		return nil, fmt.Errorf("http storage ref=%s: response exceeds maximum block size", sref)
+	} else if resp.ContentLength >= 0 && int64(len(b)) != resp.ContentLength {
+		return nil, fmt.Errorf("http storage ref=%s: got %d bytes, want Content-Length %d", sref, len(b), resp.ContentLength)
+	}
+	return b, nil
+}
@@ -0,0 +1,38 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a := r.Header.Get("Accept"); a != "application/octet-stream" {
+			t.Errorf("got Accept %s, want %s", a, "application/octet-stream")
+		}
+		v, ok := b.B[strings.TrimPrefix(r.URL.Path, "/blocks/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		eb, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(v)
+		w.Write(eb)
+	}))
+	defer srv.Close()
+	h := NewHTTPStorage(srv.URL+"/blocks/", srv.Client())
+	var buf bytes.Buffer
+	if err := Decode(h, &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	if _, err := h.Get([RefSize]byte{}); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBlockNotFound)
+	}
+}
@@ -0,0 +1,152 @@
+package eris
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+var _ json.Marshaler = Size1KiB
+var _ json.Unmarshaler = new(BlockSize)
+var _ json.Marshaler = ReadCapability{}
+var _ json.Unmarshaler = new(ReadCapability)
+
+// MarshalJSON encodes the block size as its number of bytes, returning an
+// error for a block size other than 1KiB or 32KiB.
+func (b BlockSize) MarshalJSON() ([]byte, error) {
+	if err := checkBlockSize(b); err != nil {
+		return nil, err
+	}
+	return json.Marshal(int(b))
+}
+
+// UnmarshalJSON decodes a block size given either as its number of bytes, such
+// as 1024, or as one of the names "1KiB" and "32KiB". Any block size other
+// than 1KiB or 32KiB is an error.
+func (b *BlockSize) UnmarshalJSON(data []byte) error {
+	var v BlockSize
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		switch name {
+		case "1KiB":
+			v = Size1KiB
+		case "32KiB":
+			v = Size32KiB
+		default:
+			return fmt.Errorf("block size %q: %w", name, ErrUnhandledBlockSize)
+		}
+	} else {
+		var n int
+		if err = json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("block size is neither a number nor a name: %w", err)
+		}
+		v = BlockSize(n)
+	}
+	if err := checkBlockSize(v); err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// ReadCapability is the JSON form of a read capability, in the shape used by
+// the ERIS test vectors:
+//
+//	{
+//	  "block-size": 1024,
+//	  "level": 0,
+//	  "root-reference": "BLY4QKPNR57OKIOA5BLPI5NHQHKN3GJR5F4RNY6TZFAXKSSLYYQQ",
+//	  "root-key": "JUNNKQN544MJJMGRABGDOTJAQCGF4U4Q6YW3VVHD4FGQYUSJ4YOA"
+//	}
+//
+// The root reference and key are base32 encoded without padding.
+type ReadCapability struct {
+	BlockSize BlockSize
+	Level     int
+	RootRef   [RefSize]byte
+	RootKey   [KeySize]byte
+}
+
+// NewReadCapability creates the JSON form of the Ref's read capability.
+func NewReadCapability(r Ref) ReadCapability {
+	return ReadCapability{
+		BlockSize: r.BlockSize,
+		Level:     r.Level,
+		RootRef:   r.Ref,
+		RootKey:   r.Key,
+	}
+}
+
+// Ref converts the read capability into a Ref.
+func (c ReadCapability) Ref() Ref {
+	return Ref{
+		BlockSize: c.BlockSize,
+		Level:     c.Level,
+		Ref:       c.RootRef,
+		Key:       c.RootKey,
+	}
+}
+
+// readCapabilityJSON is the wire form of a ReadCapability.
+type readCapabilityJSON struct {
+	BlockSize BlockSize `json:"block-size"`
+	Level     int       `json:"level"`
+	RootRef   string    `json:"root-reference"`
+	RootKey   string    `json:"root-key"`
+}
+
+// MarshalJSON encodes the read capability in the test vector shape.
+func (c ReadCapability) MarshalJSON() ([]byte, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return json.Marshal(readCapabilityJSON{
+		BlockSize: c.BlockSize,
+		Level:     c.Level,
+		RootRef:   enc.EncodeToString(c.RootRef[:]),
+		RootKey:   enc.EncodeToString(c.RootKey[:]),
+	})
+}
+
+// UnmarshalJSON decodes a read capability in the test vector shape,
+// returning an error for an unhandled block size or level, or a root
+// reference or key that is not 32 bytes.
+func (c *ReadCapability) UnmarshalJSON(b []byte) error {
+	var v readCapabilityJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	ref, err := enc.DecodeString(v.RootRef)
+	if err != nil {
+		return fmt.Errorf("decoding root-reference: %w", err)
+	} else if len(ref) != RefSize {
+		return fmt.Errorf("root-reference is %d bytes, want %d", len(ref), RefSize)
+	}
+	key, err := enc.DecodeString(v.RootKey)
+	if err != nil {
+		return fmt.Errorf("decoding root-key: %w", err)
+	} else if len(key) != KeySize {
+		return fmt.Errorf("root-key is %d bytes, want %d", len(key), KeySize)
+	}
+	d := ReadCapability{BlockSize: v.BlockSize, Level: v.Level}
+	copy(d.RootRef[:], ref)
+	copy(d.RootKey[:], key)
+	if err = d.check(); err != nil {
+		return err
+	}
+	*c = d
+	return nil
+}
+
+// check enforces that the read capability is representable.
+func (c ReadCapability) check() error {
+	if err := checkBlockSize(c.BlockSize); err != nil {
+		return err
+	} else if c.Level < 0 || c.Level > math.MaxUint8 {
+		return ErrLevelTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package eris
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReadCapabilityJSON(t *testing.T) {
+	// The read capability of test vector 00.
+	in := `{"block-size":1024,"level":0,"root-reference":"BLY4QKPNR57OKIOA5BLPI5NHQHKN3GJR5F4RNY6TZFAXKSSLYYQQ","root-key":"JUNNKQN544MJJMGRABGDOTJAQCGF4U4Q6YW3VVHD4FGQYUSJ4YOA"}`
+	wantURN := "urn:erisx2:AAAAV4OIFHWY67XFEHAOQVXUOWTYDVG5TEY6S6IW4PJ4SQLVJJF4MIKNDLKUDPPHDCKLBUIAJQ3U2IEARRPFHEHWFW5NJY7BJUGFESPGDQ"
+	var rc ReadCapability
+	if err := json.Unmarshal([]byte(in), &rc); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	ref := rc.Ref()
+	if urn, err := ref.URN(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if urn != wantURN {
+		t.Errorf("got %s, want %s", urn, wantURN)
+	}
+	out, err := json.Marshal(NewReadCapability(ref))
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if string(out) != in {
+		t.Errorf("got %s, want %s", out, in)
+	}
+}
+
+func TestReadCapabilityJSONMalformed(t *testing.T) {
+	const ref = "BLY4QKPNR57OKIOA5BLPI5NHQHKN3GJR5F4RNY6TZFAXKSSLYYQQ"
+	tests := []struct {
+		Name string
+		JSON string
+	}{
+		{
+			Name: "unhandled block size",
+			JSON: `{"block-size":2048,"level":0,"root-reference":"` + ref + `","root-key":"` + ref + `"}`,
+		},
+		{
+			Name: "level too large",
+			JSON: `{"block-size":1024,"level":256,"root-reference":"` + ref + `","root-key":"` + ref + `"}`,
+		},
+		{
+			Name: "short root reference",
+			JSON: `{"block-size":1024,"level":0,"root-reference":"BLY4QKPN","root-key":"` + ref + `"}`,
+		},
+		{
+			Name: "invalid root key",
+			JSON: `{"block-size":1024,"level":0,"root-reference":"` + ref + `","root-key":"not base32!"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var rc ReadCapability
+			if err := json.Unmarshal([]byte(test.JSON), &rc); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+	if _, err := json.Marshal(ReadCapability{BlockSize: 100}); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestBlockSizeJSON(t *testing.T) {
+	tests := []struct {
+		JSON    string
+		Want    BlockSize
+		WantErr bool
+	}{
+		{JSON: `1024`, Want: Size1KiB},
+		{JSON: `32768`, Want: Size32KiB},
+		{JSON: `"1KiB"`, Want: Size1KiB},
+		{JSON: `"32KiB"`, Want: Size32KiB},
+		{JSON: `2048`, WantErr: true},
+		{JSON: `"2KiB"`, WantErr: true},
+		{JSON: `1024.5`, WantErr: true},
+		{JSON: `null`, WantErr: true},
+	}
+	for _, test := range tests {
+		var b BlockSize
+		err := json.Unmarshal([]byte(test.JSON), &b)
+		if test.WantErr {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.JSON, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: got %s, want %v", test.JSON, err, nil)
+		} else if b != test.Want {
+			t.Errorf("%s: got %d, want %d", test.JSON, b, test.Want)
+		}
+	}
+	if out, err := json.Marshal(Size32KiB); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if string(out) != "32768" {
+		t.Errorf("got %s, want %s", out, "32768")
+	}
+	if _, err := json.Marshal(BlockSize(100)); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
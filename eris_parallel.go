@@ -0,0 +1,255 @@
+package eris
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DecodeParallel streams decrypted content to the writer like Decode, fetching
+// and decrypting content blocks concurrently across the given number of
+// worker goroutines.
+//
+// Inner nodes are fetched in order while walking the tree, and the decrypted
+// content blocks are passed through a reorder buffer keyed by their position
+// in the tree so that they are written in order. At most two content blocks
+// per worker are held in memory at a time.
+//
+// The Storage must be safe for concurrent use.
+func DecodeParallel(s Storage, w io.Writer, root Ref, workers int) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	}
+	if err := checkLevel(root, 0); err != nil {
+		return err
+	}
+	if workers < 1 {
+		return errors.New("number of workers must be positive")
+	} else if workers == 1 {
+		return Decode(s, w, root)
+	}
+	g, ctx := errgroup.WithContext(context.Background())
+	jobs := make(chan decodeJob)
+	results := make(chan decodeResult, workers)
+	// Bounds the content blocks in flight or awaiting reordering.
+	tokens := make(chan struct{}, 2*workers)
+	// Walk the tree, handing out the content blocks in order.
+	g.Go(func() error {
+		defer close(jobs)
+		var seq int64
+		return walkRefs(s, root, func(ref [RefSize]byte, key [KeySize]byte, level int) error {
+			if level > 0 {
+				return ctx.Err()
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			select {
+			case jobs <- decodeJob{seq: seq, ref: ref, key: key}:
+				seq++
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+	// Fetch and decrypt content blocks.
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			defer wg.Done()
+			for j := range jobs {
+				eb, err := checkedGetContext(ctx, s, j.ref, root.BlockSize)
+				if err != nil {
+					return err
+				}
+				ub, err := decrypt(eb, j.key)
+				if err != nil {
+					return err
+				}
+				select {
+				case results <- decodeResult{seq: j.seq, ub: ub}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	// Write the content blocks in order.
+	g.Go(func() error {
+		sink := newPaddingSink(w, root.BlockSize)
+		pending := make(map[int64]ubytes)
+		var next int64
+		for r := range results {
+			pending[r.seq] = r.ub
+			for ub, ok := pending[next]; ok; ub, ok = pending[next] {
+				delete(pending, next)
+				if _, err := sink.Write(ub); err != nil {
+					return err
+				}
+				next++
+				<-tokens
+			}
+		}
+		// Do not write a partial final block if decoding failed elsewhere.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := sink.Flush()
+		return err
+	})
+	return g.Wait()
+}
+
+// decodeJob is a content block to be fetched and decrypted.
+type decodeJob struct {
+	seq int64
+	ref [RefSize]byte
+	key [KeySize]byte
+}
+
+// decodeResult is a decrypted content block.
+type decodeResult struct {
+	seq int64
+	ub  ubytes
+}
+
+// encodeParallel implements encode for an Encoder with multiple Workers.
+//
+// Content blocks are read in order and assigned a sequence number, then hashed
+// and encrypted by the workers. The results pass through a reorder buffer, so
+// that they are emitted and accumulated into inner nodes in order. At most two
+// content blocks per worker are held in memory at a time.
+func (e *Encoder) encodeParallel(ctx context.Context, r io.Reader) (ref Ref, err error) {
+	if _, err = e.prepare(); err != nil {
+		return
+	}
+	p := e.prims()
+	w := e.writeFunc()
+	secret := e.key()
+	workers := e.Workers
+	g, gctx := errgroup.WithContext(ctx)
+	jobs := make(chan encodeJob)
+	results := make(chan encodeResult, workers)
+	// Padding may split the final buffer into two blocks, each of which is
+	// freed once emitted, so leave room for one more.
+	free := make(chan ubytes, 2*workers+1)
+	for i := 0; i < 2*workers; i++ {
+		free <- getPoolBuf(e.Pool, e.size)
+	}
+	defer func() {
+		for len(free) > 0 {
+			putPoolBuf(e.Pool, <-free)
+		}
+	}()
+	// Read content blocks in order.
+	g.Go(func() error {
+		defer close(jobs)
+		for seq := int64(0); ; {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			var buf ubytes
+			select {
+			case buf = <-free:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			n, err := io.ReadFull(r, buf)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			last := err != nil
+			if last {
+				if buf, err = p.pad(buf[:n], e.size); err != nil {
+					return err
+				}
+			}
+			for off := 0; off < len(buf); off += int(e.size) {
+				select {
+				case jobs <- encodeJob{seq: seq, ub: buf[off : off+int(e.size)]}:
+					seq++
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+			}
+			if last {
+				return nil
+			}
+		}
+	})
+	// Hash and encrypt content blocks.
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			defer wg.Done()
+			for j := range jobs {
+				eb, ref, key, err := p.marshalBlock(j.ub, secret)
+				if err != nil {
+					return err
+				}
+				select {
+				case results <- encodeResult{seq: j.seq, eb: eb, ref: ref, key: key}:
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	// Emit and accumulate content blocks in order.
+	g.Go(func() error {
+		pending := make(map[int64]encodeResult)
+		var next int64
+		for res := range results {
+			pending[res.seq] = res
+			for p, ok := pending[next]; ok; p, ok = pending[next] {
+				delete(pending, next)
+				if err := w(p.eb, p.ref, p.key, 0); err != nil {
+					return err
+				}
+				if err := e.acc.RecurAccumulate(p.ref, p.key); err != nil {
+					return err
+				}
+				next++
+				free <- ubytes(p.eb)
+			}
+		}
+		return gctx.Err()
+	})
+	if err = g.Wait(); err != nil {
+		return
+	}
+	ref, err = e.acc.Flush()
+	return
+}
+
+// encodeJob is a content block to be hashed and encrypted.
+type encodeJob struct {
+	seq int64
+	ub  ubytes
+}
+
+// encodeResult is an encrypted content block.
+type encodeResult struct {
+	seq int64
+	eb  ebytes
+	ref [RefSize]byte
+	key [KeySize]byte
+}
@@ -0,0 +1,197 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// allFiles lists every test vector, not only those enabled in files.
+func allFiles() (f []string) {
+	for i := 0; i <= 13; i++ {
+		f = append(f, fmt.Sprintf("test-vectors_eris-test-vector-%02d.json", i))
+	}
+	return
+}
+
+// testVector is a test vector with its content and convergence secret
+// decoded.
+type testVector struct {
+	TestVector
+	Data   []byte
+	Secret []byte
+}
+
+// forEachVector runs fn as a subtest for each test vector in allFiles.
+func forEachVector(t *testing.T, fn func(t *testing.T, v testVector)) {
+	t.Helper()
+	for _, file := range allFiles() {
+		b, err := ioutil.ReadFile("./testdata/" + file)
+		if err != nil {
+			t.Errorf("error reading %s: %v", file, err)
+			continue
+		}
+		var v testVector
+		if err = json.Unmarshal(b, &v.TestVector); err != nil {
+			t.Errorf("error unmarshalling %s: %v", file, err)
+			continue
+		}
+		v.Data, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(v.Content)
+		if err != nil {
+			t.Errorf("error decoding content %s: %v", file, err)
+			continue
+		}
+		v.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(v.ConvergenceSecret)
+		if err != nil {
+			t.Errorf("error decoding convergence secret %s: %v", file, err)
+			continue
+		}
+		t.Run(v.Name, func(t *testing.T) {
+			fn(t, v)
+		})
+	}
+}
+
+func TestDecodeParallelVectors(t *testing.T) {
+	forEachVector(t, func(t *testing.T, v testVector) {
+		rootRef := v.ReadCapability.Ref()
+		var want, got bytes.Buffer
+		if err := Decode(v, &want, rootRef); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if err := DecodeParallel(v, &got, rootRef, 4); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("parallel decoded bytes do not match serial decoded bytes")
+		}
+	})
+}
+
+func TestDecodeParallelError(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 100*int(Size1KiB))
+	_, missing, _, err := ContentBlockAt(b, root, 50)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if ref == missing {
+			return nil, fmt.Errorf("missing")
+		}
+		return b.Get(ref)
+	})
+	var buf bytes.Buffer
+	if err = DecodeParallel(s, &buf, root, 8); err == nil {
+		t.Errorf("got %v, want an error", err)
+	} else if buf.Len() > 50*int(Size1KiB) {
+		t.Errorf("got %d bytes written, want at most %d", buf.Len(), 50*int(Size1KiB))
+	}
+	if err = DecodeParallel(b, &buf, root, 0); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestEncoderWorkersVectors(t *testing.T) {
+	forEachVector(t, func(t *testing.T, v testVector) {
+		var acc BlockAccumulator
+		e := NewEncoder((&acc).Accumulate, v.Secret, v.BlockSize)
+		e.Workers = 4
+		ref, err := e.Encode(bytes.NewReader(v.Data))
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if err = acc.Diff(v.Blocks); err != nil {
+			t.Errorf("%v", err)
+		}
+		if urn, _ := ref.URN(); urn != v.URN {
+			t.Errorf("got %s, want %s", urn, v.URN)
+		}
+		if e.buf != nil {
+			t.Errorf("got a %d byte block buffer, want none", len(e.buf))
+		}
+	})
+}
+
+func TestEncoderWorkersMatchSerial(t *testing.T) {
+	// encode returns the emitted blocks in order, and the root URN.
+	encode := func(content, secret []byte, size BlockSize, workers int) (blocks [][]byte, urn string, err error) {
+		e := NewEncoder(func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+			blocks = append(blocks, append(ref[:], eblock...))
+			return nil
+		}, secret, size)
+		e.Workers = workers
+		var ref Ref
+		if ref, err = e.Encode(bytes.NewReader(content)); err != nil {
+			return
+		}
+		urn, err = ref.URN()
+		return
+	}
+	check := func(t *testing.T, content, secret []byte, size BlockSize) {
+		want, wantURN, err := encode(content, secret, size, 0)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		for _, workers := range []int{1, 2, 8} {
+			got, urn, err := encode(content, secret, size, workers)
+			if err != nil {
+				t.Errorf("%d workers: got %s, want %v", workers, err, nil)
+				continue
+			}
+			if urn != wantURN {
+				t.Errorf("%d workers: got %s, want %s", workers, urn, wantURN)
+			}
+			if len(got) != len(want) {
+				t.Errorf("%d workers: got %d blocks, want %d", workers, len(got), len(want))
+				continue
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Errorf("%d workers: block %d differs from serial encoding", workers, i)
+				}
+			}
+		}
+	}
+	forEachVector(t, func(t *testing.T, v testVector) {
+		check(t, v.Data, v.Secret, v.BlockSize)
+	})
+	// A tree of several levels, beyond the sizes of the test vectors.
+	t.Run("deep tree", func(t *testing.T) {
+		check(t, testContent(300*int(Size1KiB)+7), nil, Size1KiB)
+	})
+}
+
+func TestEncoderWorkersError(t *testing.T) {
+	want := errors.New("write failed")
+	var n int
+	w := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+		n++
+		if n == 10 {
+			return want
+		}
+		return nil
+	}
+	e := NewEncoder(w, nil, Size1KiB)
+	e.Workers = 4
+	if _, err := e.Encode(bytes.NewReader(testContent(100 * int(Size1KiB)))); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+	// The Encoder remains usable after an error.
+	var acc BlockAccumulator
+	e.Reset((&acc).Accumulate, nil, Size1KiB)
+	content := testContent(100 * int(Size1KiB))
+	ref, err := e.Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var buf bytes.Buffer
+	if err = Decode(acc, &buf, ref); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+}
@@ -0,0 +1,328 @@
+package eris
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var _ io.ReadSeeker = new(reader)
+var _ io.ReaderAt = new(readerAt)
+var _ io.ReadCloser = new(contentReader)
+
+// NewReader creates an io.ReadSeeker over the decoded content of the tree
+// descendent of the root reference. Content blocks are fetched from the
+// Storage on demand, walking only the path from the root to each content block
+// that is read.
+func NewReader(s Storage, root Ref) (io.ReadSeeker, error) {
+	return NewReadAheadReader(s, root, 0)
+}
+
+// NewReadAheadReader creates an io.ReadSeeker like NewReader, which also
+// prefetches up to window content blocks in the background after each
+// sequential read. Subsequent sequential reads are then served from the
+// already-fetched blocks.
+//
+// Seeking discards any prefetched blocks outside of the window following the
+// new position. At most window+1 content blocks are buffered at a time.
+//
+// A window of zero disables read-ahead. Otherwise, the Storage must be safe for
+// concurrent use.
+func NewReadAheadReader(s Storage, root Ref, window int) (io.ReadSeeker, error) {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return nil, err
+	}
+	if window < 0 {
+		return nil, errors.New("read-ahead window is negative")
+	}
+	return &reader{
+		s:       s,
+		root:    root,
+		window:  int64(window),
+		size:    -1,
+		lastIdx: -1,
+		blocks:  make(map[int64]*prefetch),
+	}, nil
+}
+
+// NewReaderAt creates an io.ReaderAt over the decoded content of the tree
+// descendent of the root reference. Each call to ReadAt independently walks
+// the paths from the root to the content blocks it reads.
+//
+// ReadAt is safe for concurrent use if the Storage is.
+func NewReaderAt(s Storage, root Ref) (io.ReaderAt, error) {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return nil, err
+	}
+	return readerAt{
+		s:    s,
+		root: root,
+	}, nil
+}
+
+// NewContentReader creates an io.ReadCloser over the decoded content of the
+// tree descendent of the root reference, for passing content wherever an
+// io.Reader is expected.
+//
+// Unlike NewReader, the content is decoded in a single pass by DecodeContext
+// in a background goroutine, writing into a pipe read by Read. Each inner node
+// is then fetched only once, and a BatchStorage is used as when decoding,
+// though the reader cannot seek. An error decoding the tree, including for an
+// invalid root reference, is returned by Read.
+//
+// Decoding is lazy: nothing is fetched until the first call to Read starts the
+// goroutine. Once started, the goroutine blocks on the pipe until its content
+// is read, so callers must call Close, which cancels decoding and waits for
+// the goroutine to exit so that no blocks are fetched after it returns. A
+// fetch already in progress is only cancelled if the Storage implements
+// StorageContext. The Storage must be safe for use from the background
+// goroutine.
+func NewContentReader(s Storage, root Ref) io.ReadCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	return &contentReader{
+		s:      s,
+		root:   root,
+		ctx:    ctx,
+		pr:     pr,
+		pw:     pw,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// contentReader reads from the pipe written by a decoding goroutine, started
+// by the first Read.
+type contentReader struct {
+	s      Storage
+	root   Ref
+	ctx    context.Context
+	pr     *io.PipeReader
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	start  sync.Once
+	// Closed once the goroutine exits, or by Close if it never started.
+	done chan struct{}
+}
+
+// Read reads decoded content, returning io.EOF once all of it has been read.
+func (c *contentReader) Read(p []byte) (int, error) {
+	c.start.Do(func() {
+		go func() {
+			defer close(c.done)
+			c.pw.CloseWithError(DecodeContext(c.ctx, c.s, c.pw, c.root))
+		}()
+	})
+	return c.pr.Read(p)
+}
+
+// Close stops decoding, discarding any content not yet read. It is safe to
+// call more than once.
+func (c *contentReader) Close() error {
+	c.cancel()
+	// Unblock a write into the pipe.
+	c.pr.Close()
+	// Keep a later Read from starting the goroutine.
+	c.start.Do(func() {
+		close(c.done)
+	})
+	<-c.done
+	return nil
+}
+
+// readerAt implements an io.ReaderAt over the Storage. It holds no mutable
+// state.
+type readerAt struct {
+	s    Storage
+	root Ref
+}
+
+// ReadAt reads len(p) bytes of content starting at the offset, spanning
+// multiple content blocks as needed.
+//
+// Returns io.EOF when fewer bytes are read as the content ends.
+func (r readerAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	bs := int64(r.root.BlockSize)
+	for n < len(p) {
+		var b []byte
+		b, _, _, err = ContentBlockAt(r.s, r.root, off/bs)
+		if err == errIndexOutOfRange {
+			return n, io.EOF
+		} else if err != nil {
+			return
+		}
+		bo := off % bs
+		if bo >= int64(len(b)) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], b[bo:])
+		n += c
+		off += int64(c)
+		// A final content block running out ends the content.
+		if int64(len(b)) < bs && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// prefetch is a content block being fetched in the background.
+type prefetch struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+// reader implements an io.ReadSeeker over the Storage. It is not safe for
+// concurrent use, but is safe to use alongside its own background
+// prefetching.
+type reader struct {
+	s      Storage
+	root   Ref
+	window int64
+	// Content size once known, or -1.
+	size int64
+	// Current read position, and the index of the content block last read.
+	pos     int64
+	lastIdx int64
+	// Fetched and in-flight content blocks, keyed by index.
+	mu     sync.Mutex
+	blocks map[int64]*prefetch
+}
+
+// Read fills the buffer from the content block at the current position,
+// fetching it from the Storage if needed.
+func (r *reader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	} else if r.size >= 0 && r.pos >= r.size {
+		return 0, io.EOF
+	}
+	bs := int64(r.root.BlockSize)
+	idx := r.pos / bs
+	var b []byte
+	b, err = r.block(idx)
+	if err == errIndexOutOfRange {
+		return 0, io.EOF
+	} else if err != nil {
+		return
+	}
+	// Only the final content block is shorter than the block size, which
+	// reveals the content size.
+	final := int64(len(b)) < bs
+	if final {
+		r.size = idx*bs + int64(len(b))
+	}
+	off := r.pos % bs
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n = copy(p, b[off:])
+	r.pos += int64(n)
+	// Read ahead when reading sequentially.
+	if !final && (idx == r.lastIdx || idx == r.lastIdx+1) {
+		r.readAhead(idx)
+	}
+	r.lastIdx = idx
+	return
+}
+
+// Seek sets the position of the next Read.
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		size, err := r.length()
+		if err != nil {
+			return 0, err
+		}
+		abs = size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = abs
+	r.discard(abs / int64(r.root.BlockSize))
+	return abs, nil
+}
+
+// length lazily computes the content size, if it has not already been
+// learned by reading the final content block.
+func (r *reader) length() (int64, error) {
+	if r.size < 0 {
+		size, err := ContentSize(r.s, r.root)
+		if err != nil {
+			return 0, err
+		}
+		r.size = size
+	}
+	return r.size, nil
+}
+
+// block obtains the content block at the index, waiting on a prefetch if one
+// is in flight.
+func (r *reader) block(idx int64) ([]byte, error) {
+	r.mu.Lock()
+	p := r.fetch(idx)
+	r.mu.Unlock()
+	<-p.done
+	if p.err != nil {
+		r.mu.Lock()
+		delete(r.blocks, idx)
+		r.mu.Unlock()
+	}
+	return p.b, p.err
+}
+
+// readAhead discards content blocks before the index and begins prefetching
+// the window of content blocks following it.
+func (r *reader) readAhead(idx int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.discardLocked(idx)
+	for i := idx + 1; i <= idx+r.window; i++ {
+		r.fetch(i)
+	}
+}
+
+// discard drops all content blocks outside of the window starting at the
+// index.
+func (r *reader) discard(idx int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.discardLocked(idx)
+}
+
+// discardLocked implements discard, and must be called with the lock held.
+func (r *reader) discardLocked(idx int64) {
+	for i := range r.blocks {
+		if i < idx || i > idx+r.window {
+			delete(r.blocks, i)
+		}
+	}
+}
+
+// fetch returns the existing fetch for the content block at the index, or
+// starts fetching it in the background. Must be called with the lock held.
+func (r *reader) fetch(idx int64) *prefetch {
+	if p, ok := r.blocks[idx]; ok {
+		return p
+	}
+	p := &prefetch{done: make(chan struct{})}
+	r.blocks[idx] = p
+	go func() {
+		defer close(p.done)
+		p.b, _, _, p.err = ContentBlockAt(r.s, r.root, idx)
+	}()
+	return p
+}
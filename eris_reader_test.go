@@ -0,0 +1,325 @@
+package eris
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	for _, window := range []int{0, 4} {
+		t.Run(fmt.Sprintf("read-ahead %d", window), func(t *testing.T) {
+			r, err := NewReadAheadReader(b, root, window)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(got, content) {
+				t.Errorf("got %d bytes, want %d matching bytes", len(got), len(content))
+			}
+			// Seek back into the middle, then to the end.
+			off, err := r.Seek(17*int64(Size1KiB)+3, io.SeekStart)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			buf := make([]byte, 2000)
+			n, err := io.ReadFull(r, buf)
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(buf[:n], content[off:off+int64(n)]) {
+				t.Errorf("bytes read after seek do not match content")
+			}
+			off, err = r.Seek(-10, io.SeekEnd)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if off != int64(len(content)-10) {
+				t.Errorf("got offset %d, want %d", off, len(content)-10)
+			}
+			got, err = ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(got, content[len(content)-10:]) {
+				t.Errorf("bytes read after seek to end do not match content")
+			}
+		})
+	}
+}
+
+func TestReaderFetchesOnlyPath(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	var n int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		return b.Get(ref)
+	})
+	r, err := NewReader(s, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	off := 33*int64(Size1KiB) + 5
+	if _, err = r.Seek(off, io.SeekStart); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	buf := make([]byte, 10)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if !bytes.Equal(buf, content[off:off+10]) {
+		t.Errorf("bytes read after seek do not match content")
+	}
+	// The root, a level 1 inner node, and the content block.
+	if n != root.Level+1 {
+		t.Errorf("got %d fetches, want %d", n, root.Level+1)
+	}
+	// Reading past the end is an EOF.
+	if _, err = r.Seek(int64(len(content))+int64(Size1KiB)*100, io.SeekStart); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if _, err = r.Read(buf); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	r, err := NewReaderAt(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	tests := []struct {
+		Name   string
+		Offset int64
+		Length int
+		N      int
+		Err    error
+	}{
+		{
+			Name:   "within one block",
+			Offset: 10,
+			Length: 100,
+			N:      100,
+		},
+		{
+			Name:   "spanning blocks",
+			Offset: 15*int64(Size1KiB) + 1000,
+			Length: 3 * int(Size1KiB),
+			N:      3 * int(Size1KiB),
+		},
+		{
+			Name:   "to the end",
+			Offset: int64(len(content)) - 50,
+			Length: 50,
+			N:      50,
+		},
+		{
+			Name:   "past the end",
+			Offset: int64(len(content)) - 50,
+			Length: 100,
+			N:      50,
+			Err:    io.EOF,
+		},
+		{
+			Name:   "beyond the end",
+			Offset: int64(len(content)) + 5000,
+			Length: 100,
+			N:      0,
+			Err:    io.EOF,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			p := make([]byte, test.Length)
+			n, err := r.ReadAt(p, test.Offset)
+			if err != test.Err {
+				t.Errorf("got %v, want %v", err, test.Err)
+			}
+			if n != test.N {
+				t.Fatalf("got %d bytes, want %d", n, test.N)
+			}
+			if n > 0 && !bytes.Equal(p[:n], content[test.Offset:test.Offset+int64(n)]) {
+				t.Errorf("bytes read do not match content")
+			}
+		})
+	}
+	// Concurrent reads share no cursor state.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off := int64(i) * 5 * int64(Size1KiB)
+			p := make([]byte, 2*Size1KiB)
+			if _, err := r.ReadAt(p, off); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(p, content[off:off+int64(len(p))]) {
+				t.Errorf("concurrent bytes read do not match content")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkReadAheadReader(b *testing.B) {
+	content := testContent(64 * int(Size1KiB))
+	var acc BlockAccumulator
+	root, err := Encode1KiB((&acc).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		b.Fatalf("got %s, want %v", err, nil)
+	}
+	slow := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		time.Sleep(100 * time.Microsecond)
+		return acc.Get(ref)
+	})
+	for _, window := range []int{0, 4} {
+		b.Run(fmt.Sprintf("read-ahead %d", window), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				r, err := NewReadAheadReader(slow, root, window)
+				if err != nil {
+					b.Fatalf("got %s, want %v", err, nil)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatalf("got %s, want %v", err, nil)
+				}
+			}
+		})
+	}
+}
+
+func TestContentReader(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	r := NewContentReader(b, root)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("read bytes do not match content")
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	// Errors decoding are returned by Read.
+	bad := root
+	bad.Ref[0] ^= 0xFF
+	r = NewContentReader(b, bad)
+	defer r.Close()
+	if _, err = ioutil.ReadAll(r); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+	r = NewContentReader(b, Ref{BlockSize: 100})
+	defer r.Close()
+	if _, err = ioutil.ReadAll(r); err != ErrUnhandledBlockSize {
+		t.Errorf("got %v, want %v", err, ErrUnhandledBlockSize)
+	}
+}
+
+func TestContentReaderLazy(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB))
+	var mu sync.Mutex
+	var gets int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		return b.Get(ref)
+	})
+	// Nothing is fetched until the first Read.
+	r := NewContentReader(s, root)
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if gets != 0 {
+		t.Errorf("got %d fetches before Read, want %d", gets, 0)
+	}
+	mu.Unlock()
+	if got, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("read bytes do not match content")
+	}
+	r.Close()
+	// Closing a reader never read fetches nothing, nor does a later Read.
+	mu.Lock()
+	gets = 0
+	mu.Unlock()
+	r = NewContentReader(s, root)
+	if err := r.Close(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != io.ErrClosedPipe {
+		t.Errorf("got %v, want %v", err, io.ErrClosedPipe)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if gets != 0 {
+		t.Errorf("got %d fetches, want %d", gets, 0)
+	}
+	mu.Unlock()
+}
+
+func TestContentReaderClose(t *testing.T) {
+	b, root, content := encodeTestContent(t, 300*int(Size1KiB))
+	var mu sync.Mutex
+	var gets int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		return b.Get(ref)
+	})
+	r := NewContentReader(s, root)
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(p, content[:10]) {
+		t.Errorf("read bytes do not match content")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	// The decoding goroutine has exited, so fetching has stopped well short
+	// of the whole tree.
+	mu.Lock()
+	n := gets
+	mu.Unlock()
+	if n >= b.N {
+		t.Errorf("got %d fetches, want fewer than %d", n, b.N)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if gets != n {
+		t.Errorf("got %d fetches after Close, want %d", gets, n)
+	}
+	mu.Unlock()
+	if _, err := r.Read(p); err != io.ErrClosedPipe {
+		t.Errorf("got %v, want %v", err, io.ErrClosedPipe)
+	}
+	// A fetch blocked in GetContext is cancelled by Close.
+	_, block, _, err := ContentBlockAt(b, root, 4)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	r = NewContentReader(contextStorage{BlockAccumulator: b, block: block}, root)
+	if _, err = io.ReadFull(r, p); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close did not return while a fetch was blocked")
+	}
+}
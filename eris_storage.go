@@ -0,0 +1,437 @@
+package eris
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrBlockNotFound is returned by a Storage that definitively does not have a
+// requested block, as opposed to one failing to fetch it. The Storages of this
+// package return an error wrapping it, so that a missing block can be told
+// apart from a failing backend.
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockStore is a Storage that blocks may also be written to, so that the same
+// backend may be used for both encoding and decoding.
+type BlockStore interface {
+	Storage
+	// Put stores the encrypted block under its reference. A block that does
+	// not hash to the reference is rejected with a RefMismatchError, rather
+	// than poisoning the store until it is next fetched.
+	Put(eblock []byte, ref [RefSize]byte) error
+}
+
+// StoreWriteFunc adapts the BlockStore into a WriteFunc, so that encoded
+// blocks are written directly to it.
+func StoreWriteFunc(bs BlockStore) WriteFunc {
+	return func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+		return bs.Put(eblock, ref)
+	}
+}
+
+var _ Storage = new(SingleflightStore)
+var _ Storage = new(copyingStore)
+var _ BlockStore = new(MemStorage)
+var _ StorageContext = new(CachingStorage)
+var _ BatchStorage = batchCachingStorage{}
+var _ Storage = new(MultiStorage)
+var _ WriteFunc = new(MemStorage).WriteFunc
+
+// SingleflightStore is a Storage decorator that collapses concurrent Get calls
+// for the same reference into a single call to the underlying Storage, sharing
+// the result with every caller.
+//
+// Blocks are immutable, so a shared result is always correct. This reduces
+// redundant load on the underlying Storage when multiple goroutines traverse
+// the same hot inner nodes.
+type SingleflightStore struct {
+	s Storage
+	g singleflight.Group
+}
+
+// NewSingleflightStore creates a new SingleflightStore wrapping the Storage.
+func NewSingleflightStore(s Storage) *SingleflightStore {
+	return &SingleflightStore{s: s}
+}
+
+// Get fetches the block from the underlying Storage, unless a fetch for the
+// same reference is already in flight, in which case it waits for and shares
+// that result.
+//
+// Shared results are copied for each caller, since decoding decrypts blocks
+// in-place.
+func (f *SingleflightStore) Get(ref [RefSize]byte) ([]byte, error) {
+	v, err, shared := f.g.Do(string(ref[:]), func() (interface{}, error) {
+		return f.s.Get(ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := v.([]byte)
+	if shared {
+		c := make([]byte, len(b))
+		copy(c, b)
+		b = c
+	}
+	return b, nil
+}
+
+// CrossCheck audits that two Storages are consistent by fetching each
+// reference from both and comparing the returned bytes. Since blocks are
+// content-addressed, any difference indicates corruption in one of them.
+//
+// Returns the references where the bytes differ or where only one of the
+// Storages was able to return the block. An error is returned only if neither
+// Storage has a block, as no comparison can be made, which wraps
+// ErrBlockNotFound if both reported the block as not found.
+func CrossCheck(a, b Storage, refs [][RefSize]byte) (mismatched [][RefSize]byte, err error) {
+	for _, ref := range refs {
+		ab, aerr := a.Get(ref)
+		bb, berr := b.Get(ref)
+		if aerr != nil && berr != nil {
+			msg := "cannot cross check: neither storage has ref=" +
+				base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+			if errors.Is(aerr, ErrBlockNotFound) && errors.Is(berr, ErrBlockNotFound) {
+				err = fmt.Errorf("%s: %w", msg, ErrBlockNotFound)
+			} else {
+				err = errors.New(msg)
+			}
+			return
+		} else if aerr != nil || berr != nil || !bytes.Equal(ab, bb) {
+			mismatched = append(mismatched, ref)
+		}
+	}
+	return
+}
+
+// CopyingStore wraps the Storage so that every call to Get returns a fresh copy
+// of the bytes returned by the underlying Storage.
+//
+// Any caller that mutates the returned bytes, such as by decrypting them
+// in-place, corrupts a Storage that caches and hands out the same underlying
+// slice on each call. Wrapping such a Storage guarantees that the caller
+// exclusively owns every returned slice.
+func CopyingStore(s Storage) Storage {
+	return copyingStore{s: s}
+}
+
+// copyingStore implements CopyingStore.
+type copyingStore struct {
+	s Storage
+}
+
+// Get returns a copy of the block fetched from the underlying Storage.
+func (c copyingStore) Get(ref [RefSize]byte) ([]byte, error) {
+	b, err := c.s.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	return cp, nil
+}
+
+// MemStorage is an in-memory Storage of encrypted blocks, safe for concurrent
+// use.
+//
+// Its WriteFunc method allows the output of encoding to be piped directly into
+// it, which may then be decoded back out.
+type MemStorage struct {
+	mu sync.RWMutex
+	m  map[[RefSize]byte][]byte
+}
+
+// NewMemStorage creates an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		m: make(map[[RefSize]byte][]byte),
+	}
+}
+
+// Get returns a copy of the block with the reference, or an error wrapping
+// ErrBlockNotFound if it is not stored.
+func (m *MemStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	m.mu.RLock()
+	b, ok := m.m[ref]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("memory storage ref=%s: %w",
+			base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:]), ErrBlockNotFound)
+	}
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	return cp, nil
+}
+
+// Put stores a copy of the encrypted block under its reference, returning a
+// RefMismatchError without storing it if the block hashes to another
+// reference.
+//
+// The block is hashed with blake2b-256, so blocks encoded with another
+// HashProvider must be stored with WriteFunc instead.
+func (m *MemStorage) Put(eblock []byte, ref [RefSize]byte) error {
+	if err := checkPutRef(eblock, ref); err != nil {
+		return err
+	}
+	m.put(eblock, ref)
+	return nil
+}
+
+// WriteFunc stores a copy of the encrypted block, and matches the WriteFunc
+// signature so that it may be passed to an encoder.
+func (m *MemStorage) WriteFunc(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+	m.put(eblock, ref)
+	return nil
+}
+
+// checkPutRef enforces that a block being stored hashes to its reference.
+func checkPutRef(eblock []byte, ref [RefSize]byte) error {
+	if got := toRef(eblock); got != ref {
+		return RefMismatchError{Expected: ref, Got: got, Storing: true}
+	}
+	return nil
+}
+
+// put stores a copy of the encrypted block under the reference.
+func (m *MemStorage) put(eblock []byte, ref [RefSize]byte) {
+	cp := make([]byte, len(eblock))
+	copy(cp, eblock)
+	m.mu.Lock()
+	if m.m == nil {
+		m.m = make(map[[RefSize]byte][]byte)
+	}
+	m.m[ref] = cp
+	m.mu.Unlock()
+}
+
+// Len returns the number of blocks stored.
+func (m *MemStorage) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.m)
+}
+
+// CachingStorage is a Storage decorator that keeps the most recently used
+// blocks in memory, evicting the least recently used ones once the cached
+// bytes exceed a limit. It is safe for concurrent use.
+//
+// Since blocks are content-addressed, cached blocks never become stale and are
+// never invalidated.
+//
+// A block missing from the cache is fetched with the context of GetContext if
+// the inner Storage implements StorageContext. When a Decoder caches blocks of
+// an inner BatchStorage, the blocks missing from its cache are fetched with
+// GetMany.
+type CachingStorage struct {
+	inner    Storage
+	maxBytes int
+	// Notified of hits and misses, if not nil.
+	metrics Metrics
+	// mutable state
+	mu     sync.Mutex
+	lru    *list.List
+	m      map[[RefSize]byte]*list.Element
+	n      int
+	hits   uint64
+	misses uint64
+}
+
+// cacheEntry is a block within the CachingStorage.
+type cacheEntry struct {
+	ref [RefSize]byte
+	b   []byte
+}
+
+// NewCachingStorage creates a CachingStorage around the inner Storage, caching
+// at most maxBytes of blocks.
+func NewCachingStorage(inner Storage, maxBytes int) *CachingStorage {
+	return &CachingStorage{
+		inner:    inner,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		m:        make(map[[RefSize]byte]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached block, or fetches it from the inner Storage
+// and caches it.
+func (c *CachingStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	return c.GetContext(context.Background(), ref)
+}
+
+// GetContext is like Get, fetching a block missing from the cache with the
+// context if the inner Storage implements StorageContext.
+func (c *CachingStorage) GetContext(ctx context.Context, ref [RefSize]byte) ([]byte, error) {
+	if b, ok := c.lookup(ref); ok {
+		return b, nil
+	}
+	b, err := getBlock(ctx, c.inner, ref)
+	if err != nil {
+		return nil, err
+	}
+	c.add(ref, b)
+	return b, nil
+}
+
+// getMany returns copies of the cached blocks, fetching those missing from the
+// cache with a single call to GetMany of the inner BatchStorage.
+func (c *CachingStorage) getMany(bs BatchStorage, refs [][RefSize]byte) ([][]byte, error) {
+	blocks := make([][]byte, len(refs))
+	var missing [][RefSize]byte
+	var idx []int
+	for i, ref := range refs {
+		if b, ok := c.lookup(ref); ok {
+			blocks[i] = b
+		} else {
+			missing = append(missing, ref)
+			idx = append(idx, i)
+		}
+	}
+	if len(missing) == 0 {
+		return blocks, nil
+	}
+	fetched, err := bs.GetMany(missing)
+	if err != nil {
+		return nil, err
+	} else if len(fetched) != len(missing) {
+		return nil, errors.New("error fetching references from BatchStorage: returned incorrect number of blocks")
+	}
+	for j, i := range idx {
+		blocks[i] = fetched[j]
+		c.add(missing[j], fetched[j])
+	}
+	return blocks, nil
+}
+
+// lookup returns a copy of the cached block, counting the hit or miss.
+func (c *CachingStorage) lookup(ref [RefSize]byte) ([]byte, bool) {
+	c.mu.Lock()
+	if e, ok := c.m[ref]; ok {
+		c.hits++
+		c.lru.MoveToFront(e)
+		b := e.Value.(*cacheEntry).b
+		cp := make([]byte, len(b))
+		copy(cp, b)
+		c.mu.Unlock()
+		if c.metrics != nil {
+			c.metrics.CacheHit()
+		}
+		return cp, true
+	}
+	c.misses++
+	c.mu.Unlock()
+	if c.metrics != nil {
+		c.metrics.CacheMiss()
+	}
+	return nil, false
+}
+
+// batchCachingStorage is a CachingStorage around a BatchStorage, so that a
+// Decoder caching its blocks still fetches the children of each inner node
+// with GetMany.
+type batchCachingStorage struct {
+	*CachingStorage
+	bs BatchStorage
+}
+
+// GetMany returns the cached blocks, fetching the rest with GetMany of the
+// inner BatchStorage.
+func (b batchCachingStorage) GetMany(refs [][RefSize]byte) ([][]byte, error) {
+	return b.getMany(b.bs, refs)
+}
+
+// Stats returns the number of calls to Get that were served from the cache
+// and those that fetched from the inner Storage.
+func (c *CachingStorage) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// add caches a copy of the block, evicting the least recently used blocks as
+// needed to stay within the limit.
+func (c *CachingStorage) add(ref [RefSize]byte, b []byte) {
+	if len(b) > c.maxBytes {
+		return
+	}
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[ref]; ok {
+		return
+	}
+	c.m[ref] = c.lru.PushFront(&cacheEntry{ref: ref, b: cp})
+	c.n += len(cp)
+	for c.n > c.maxBytes {
+		e := c.lru.Back()
+		ce := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.m, ce.ref)
+		c.n -= len(ce.b)
+	}
+}
+
+// MultiStorage is a Storage that tries each of its sources in order, such as a
+// local cache, then a LAN peer, then a remote server, returning the first
+// block successfully fetched.
+type MultiStorage struct {
+	// WriteBack enables writing a block fetched from a later source into all
+	// of the earlier sources that are BlockStores, so that subsequent fetches
+	// are served by the faster sources. A block is only written back if it
+	// matches its reference.
+	WriteBack bool
+	sources   []Storage
+}
+
+// NewMultiStorage creates a MultiStorage trying the sources in the order given.
+func NewMultiStorage(sources ...Storage) *MultiStorage {
+	return &MultiStorage{
+		sources: sources,
+	}
+}
+
+// Get fetches the block from the first source able to return it.
+//
+// Returns an error aggregating the errors from every source only if all of
+// them fail, which wraps ErrBlockNotFound if every source reported the block
+// as not found.
+func (m *MultiStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	var errs []string
+	notFound := true
+	for i, s := range m.sources {
+		b, err := s.Get(ref)
+		if err != nil {
+			errs = append(errs, err.Error())
+			notFound = notFound && errors.Is(err, ErrBlockNotFound)
+			continue
+		}
+		if m.WriteBack && i > 0 && toRef(b) == ref {
+			for _, early := range m.sources[:i] {
+				if bs, ok := early.(BlockStore); ok {
+					// Failing to cache the block does not fail the fetch.
+					_ = bs.Put(b, ref)
+				}
+			}
+		}
+		return b, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("multi storage has no sources")
+	}
+	msg := "no source has ref=" +
+		base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:]) +
+		": " + strings.Join(errs, "; ")
+	if notFound {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, msg)
+	}
+	return nil, errors.New(msg)
+}
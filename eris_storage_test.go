@@ -0,0 +1,302 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var _ Storage = StorageFunc(nil)
+
+type StorageFunc func(ref [RefSize]byte) ([]byte, error)
+
+func (s StorageFunc) Get(ref [RefSize]byte) ([]byte, error) {
+	return s(ref)
+}
+
+func TestSingleflightStore(t *testing.T) {
+	const n = 16
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(100)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var calls int32
+	release := make(chan struct{})
+	s := NewSingleflightStore(StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return b.Get(ref)
+	}))
+	var started, done sync.WaitGroup
+	started.Add(n)
+	done.Add(n)
+	results := make([][]byte, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			results[i], errs[i] = s.Get(root.Ref)
+		}(i)
+	}
+	started.Wait()
+	// Give every goroutine the chance to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	done.Wait()
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("got %d underlying calls, want %d", c, 1)
+	}
+	want, _ := b.Get(root.Ref)
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Errorf("got %s, want %v", errs[i], nil)
+		} else if !bytes.Equal(results[i], want) {
+			t.Errorf("result %d does not match underlying block", i)
+		}
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	var b BlockAccumulator
+	_, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(20*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var refs [][RefSize]byte
+	for k := range b.B {
+		var ref [RefSize]byte
+		rb, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(k)
+		copy(ref[:], rb)
+		refs = append(refs, ref)
+	}
+	corrupt := refs[3]
+	corrupted := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		eb, err := b.Get(ref)
+		if err == nil && ref == corrupt {
+			eb[0] ^= 0xFF
+		}
+		return eb, err
+	})
+	mismatched, err := CrossCheck(b, corrupted, refs)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if len(mismatched) != 1 {
+		t.Fatalf("got %d mismatched refs, want %d", len(mismatched), 1)
+	} else if mismatched[0] != corrupt {
+		t.Errorf("got mismatched ref %v, want %v", mismatched[0], corrupt)
+	}
+	// A block missing from only one storage is a mismatch.
+	missing := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if ref == corrupt {
+			return nil, fmt.Errorf("missing")
+		}
+		return b.Get(ref)
+	})
+	mismatched, err = CrossCheck(missing, b, refs)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if len(mismatched) != 1 {
+		t.Errorf("got %d mismatched refs, want %d", len(mismatched), 1)
+	}
+	// A block missing from both storages cannot be cross checked.
+	empty := NewMemStorage()
+	if _, err = CrossCheck(empty, empty, refs); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBlockNotFound)
+	}
+	if _, err = CrossCheck(missing, empty, [][RefSize]byte{corrupt}); err == nil || errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want an error not wrapping %v", err, ErrBlockNotFound)
+	}
+}
+
+// sharedBufferStorage hands out the same underlying slice for a reference on
+// every call to Get.
+func sharedBufferStorage(b BlockAccumulator) Storage {
+	cache := make(map[[RefSize]byte][]byte)
+	return StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if eb, ok := cache[ref]; ok {
+			return eb, nil
+		}
+		eb, err := b.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		cache[ref] = eb
+		return eb, nil
+	})
+}
+
+func TestCopyingStore(t *testing.T) {
+	b, root, content := encodeTestContent(t, 20*int(Size1KiB))
+	s := CopyingStore(sharedBufferStorage(b))
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		if err := Decode(s, &buf, root); err != nil {
+			t.Fatalf("decode %d: got %s, want %v", i, err, nil)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("decode %d: decoded bytes do not match content", i)
+		}
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	m := NewMemStorage()
+	root, err := Encode1KiB(m.WriteFunc, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if m.Len() != 45 {
+		t.Errorf("got %d blocks, want %d", m.Len(), 45)
+	}
+	var buf bytes.Buffer
+	if err = Decode(m, &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	eb, err := m.Get(root.Ref)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	other := NewMemStorage()
+	if err = other.Put(eb, root.Ref); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	// A block is not stored under another reference.
+	var rm RefMismatchError
+	if err = other.Put(eb, [RefSize]byte{1}); !errors.As(err, &rm) {
+		t.Errorf("got %v, want a RefMismatchError", err)
+	} else if rm.Got != root.Ref || !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("got %v, want the block's reference %v", rm.Got, root.Ref)
+	} else if other.Len() != 1 {
+		t.Errorf("got %d blocks, want %d", other.Len(), 1)
+	}
+	if _, err = other.Get([RefSize]byte{}); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBlockNotFound)
+	}
+	// Concurrent use.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			eb := testContent(i + 1)
+			if err := other.Put(eb, toRef(eb)); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			}
+			if _, err := other.Get(root.Ref); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStoreWriteFunc(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	stores := []BlockStore{NewMemStorage()}
+	if f, err := NewFSStorage(t.TempDir()); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else {
+		stores = append(stores, f)
+	}
+	for _, bs := range stores {
+		t.Run(fmt.Sprintf("%T", bs), func(t *testing.T) {
+			root, err := Encode1KiB(StoreWriteFunc(bs), bytes.NewReader(content), nil)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			var buf bytes.Buffer
+			if err = Decode(bs, &buf, root); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("decoded bytes do not match content")
+			}
+		})
+	}
+}
+
+func TestCachingStorage(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	var n int
+	inner := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		return b.Get(ref)
+	})
+	// Large enough for every block.
+	c := NewCachingStorage(inner, 45*int(Size1KiB))
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := Decode(c, &buf, root); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		} else if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("decoded bytes do not match content")
+		}
+	}
+	if n != 45 {
+		t.Errorf("got %d inner fetches, want %d", n, 45)
+	}
+	if hits, misses := c.Stats(); hits != 45 || misses != 45 {
+		t.Errorf("got %d hits and %d misses, want %d and %d", hits, misses, 45, 45)
+	}
+	// Only room for two blocks evicts the least recently used.
+	n = 0
+	c = NewCachingStorage(inner, 2*int(Size1KiB))
+	refs, err := ListRefs(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, ref := range []int{0, 1, 0, 2, 1} {
+		if _, err = c.Get(refs[ref]); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	if hits, misses := c.Stats(); hits != 1 || misses != 4 {
+		t.Errorf("got %d hits and %d misses, want %d and %d", hits, misses, 1, 4)
+	}
+}
+
+func TestMultiStorage(t *testing.T) {
+	content := testContent(10 * int(Size1KiB))
+	remote := NewMemStorage()
+	root, err := Encode1KiB(remote.WriteFunc, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	local := NewMemStorage()
+	m := NewMultiStorage(local, remote)
+	m.WriteBack = true
+	var buf bytes.Buffer
+	if err = Decode(m, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	if local.Len() != remote.Len() {
+		t.Errorf("got %d blocks written back, want %d", local.Len(), remote.Len())
+	}
+	// The local source alone now serves the entire tree.
+	buf.Reset()
+	if err = Decode(NewMultiStorage(local), &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if _, err = m.Get([RefSize]byte{}); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBlockNotFound)
+	}
+	// A failing source is not a missing block.
+	failing := StorageFunc(func([RefSize]byte) ([]byte, error) {
+		return nil, errors.New("backend unavailable")
+	})
+	if _, err = NewMultiStorage(local, failing).Get([RefSize]byte{}); err == nil || errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("got %v, want an error not wrapping %v", err, ErrBlockNotFound)
+	}
+}
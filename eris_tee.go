@@ -0,0 +1,109 @@
+package eris
+
+import (
+	"errors"
+	"io"
+)
+
+var _ io.Writer = new(EncodingTee)
+
+// EncodingTee encodes the content written to it, emitting the blocks to its
+// WriteFunc once each block of content is complete. It computes the read
+// capability of content that is already being streamed elsewhere, without
+// reading the content twice, such as when combined with io.MultiWriter or
+// io.TeeReader:
+//
+//	tee, err := NewEncodingTee(w, secret, Size32KiB)
+//	...
+//	_, err = io.Copy(io.MultiWriter(dst, tee), src)
+//	...
+//	root, err := tee.Close()
+//
+// The root reference is the same as encoding the same content with Encode.
+// An EncodingTee is not safe for concurrent use.
+type EncodingTee struct {
+	size BlockSize
+	mFn  marshalFn
+	acc  *accumulator
+	// Content of the incomplete block.
+	buf []byte
+	n   int
+	err error
+}
+
+// NewEncodingTee creates an EncodingTee emitting blocks of the given size to the
+// WriteFunc, using the optional convergence secret.
+func NewEncodingTee(w WriteFunc, secret []byte, size BlockSize) (*EncodingTee, error) {
+	if err := ValidBlockSize(size); err != nil {
+		return nil, err
+	}
+	mFn, acc, err := newMarshaller(primitives{}, w.Leveled(), secret, size)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodingTee{
+		size: size,
+		mFn:  mFn,
+		acc:  acc,
+		buf:  make([]byte, size),
+	}, nil
+}
+
+// Write buffers the content, encoding each block once it is complete.
+//
+// Once encoding a block fails, the error is returned by every later call to
+// Write and Close.
+func (e *EncodingTee) Write(b []byte) (n int, err error) {
+	if e.err != nil {
+		err = e.err
+		return
+	}
+	for len(b) > 0 {
+		c := copy(e.buf[e.n:], b)
+		e.n += c
+		n += c
+		b = b[c:]
+		if e.n < len(e.buf) {
+			break
+		}
+		e.n = 0
+		if err = e.mFn(e.buf); err != nil {
+			e.err = err
+			return
+		}
+	}
+	return
+}
+
+// Close pads and encodes the final block and emits the remaining inner nodes,
+// returning the root reference. No further content may be written.
+func (e *EncodingTee) Close() (ref Ref, err error) {
+	if e.err != nil {
+		err = e.err
+		return
+	}
+	e.err = errors.New("encoding tee is closed")
+	if err = e.mFn(padContentBlock(e.buf[:e.n], e.size)); err != nil {
+		e.err = err
+		return
+	}
+	return e.acc.Flush()
+}
+
+// Reencode re-encodes the content of the tree descendent of the root reference
+// with a new convergence secret, emitting the new blocks to the WriteFunc and
+// returning the new root reference. The block size is unchanged.
+//
+// The content is streamed from Decode into an EncodingTee a block at a time,
+// so it is never held in memory as a whole, and no goroutine is needed to
+// connect the two.
+func Reencode(s Storage, w WriteFunc, root Ref, newSecret []byte) (ref Ref, err error) {
+	tee, err := NewEncodingTee(w, newSecret, root.BlockSize)
+	if err != nil {
+		return
+	}
+	if err = Decode(s, tee, root); err != nil {
+		return
+	}
+	return tee.Close()
+}
@@ -0,0 +1,117 @@
+package eris
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEncodingTee(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		Size BlockSize
+		N    int
+	}{
+		{"Empty", Size1KiB, 0},
+		{"Short", Size1KiB, 100},
+		{"ExactMultiple", Size1KiB, 16 * int(Size1KiB)},
+		{"Tree", Size1KiB, 300*int(Size1KiB) + 7},
+		{"32KiB", Size32KiB, 3*int(Size32KiB) + 1},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			content := testContent(test.N)
+			var want BlockAccumulator
+			wantRef, err := Encode((&want).Accumulate, bytes.NewReader(content), nil, test.Size)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			var got BlockAccumulator
+			tee, err := NewEncodingTee((&got).Accumulate, nil, test.Size)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			// Write in chunks not aligned to blocks, passing the content
+			// through to another writer.
+			var through bytes.Buffer
+			n, err := io.CopyBuffer(io.MultiWriter(&through, tee), bytes.NewReader(content), make([]byte, 333))
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if n != int64(test.N) {
+				t.Errorf("got %d bytes, want %d", n, test.N)
+			}
+			ref, err := tee.Close()
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if !ref.Equal(wantRef) {
+				t.Errorf("got %v, want %v", ref, wantRef)
+			} else if len(got.B) != len(want.B) {
+				t.Errorf("got %d blocks, want %d", len(got.B), len(want.B))
+			}
+			if !bytes.Equal(through.Bytes(), content) {
+				t.Errorf("passed through bytes do not match content")
+			}
+			if _, err = tee.Write([]byte{1}); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+			if _, err = tee.Close(); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+}
+
+func TestEncodingTeeWriteFuncError(t *testing.T) {
+	want := errors.New("write failed")
+	tee, err := NewEncodingTee(func([]byte, [RefSize]byte, [KeySize]byte) error {
+		return want
+	}, nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	n, err := tee.Write(testContent(int(Size1KiB) + 10))
+	if !errors.Is(err, want) {
+		t.Errorf("got %v, want %v", err, want)
+	} else if n != int(Size1KiB) {
+		t.Errorf("got %d bytes, want %d", n, Size1KiB)
+	}
+	if _, err = tee.Close(); !errors.Is(err, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+	if _, err = NewEncodingTee(nil, nil, BlockSize(100)); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestReencode(t *testing.T) {
+	content := testContent(300*int(Size1KiB) + 7)
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(content), []byte("old secret"))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var want BlockAccumulator
+	wantRef, err := Encode1KiB((&want).Accumulate, bytes.NewReader(content), []byte("new secret"))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var got BlockAccumulator
+	ref, err := Reencode(b, (&got).Accumulate, root, []byte("new secret"))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !ref.Equal(wantRef) {
+		t.Errorf("got %v, want %v", ref, wantRef)
+	} else if len(got.B) != len(want.B) {
+		t.Errorf("got %d blocks, want %d", len(got.B), len(want.B))
+	}
+	var buf bytes.Buffer
+	if err = Decode(got, &buf, ref); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// A failed decode emits no root.
+	if _, err = Reencode(want, (&got).Accumulate, root, nil); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
@@ -2,13 +2,28 @@ package eris
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/go-test/deep"
 	"golang.org/x/crypto/blake2b"
@@ -16,6 +31,7 @@ import (
 )
 
 var _ Storage = new(TestVector)
+var _ Storage = new(BlockAccumulator)
 
 type TestVector struct {
 	Id                int                    `json:"id"`
@@ -24,7 +40,7 @@ type TestVector struct {
 	Content           string                 `json:"content"`
 	ConvergenceSecret string                 `json:"convergence-secret"`
 	BlockSize         BlockSize              `json:"block-size"`
-	ReadCapability    TestReadCap            `json:"read-capability"`
+	ReadCapability    ReadCapability         `json:"read-capability"`
 	URN               string                 `json:"urn"`
 	Blocks            map[string]interface{} `json:"blocks"`
 }
@@ -39,31 +55,6 @@ func (t TestVector) Get(ref [RefSize]byte) ([]byte, error) {
 	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(sv)
 }
 
-type TestReadCap struct {
-	BlockSize BlockSize `json:"block-size"`
-	Level     int       `json:"level"`
-	RootRef   string    `json:"root-reference"`
-	RootKey   string    `json:"root-key"`
-}
-
-func (t TestReadCap) AsRef() (Ref, error) {
-	r := Ref{
-		BlockSize: t.BlockSize,
-		Level:     t.Level,
-	}
-	rbuf, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(t.RootRef)
-	if err != nil {
-		return r, err
-	}
-	kbuf, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(t.RootKey)
-	if err != nil {
-		return r, err
-	}
-	copy(r.Ref[:], rbuf)
-	copy(r.Key[:], kbuf)
-	return r, nil
-}
-
 var files []string = []string{
 	/*"test-vectors_eris-test-vector-00.json",
 	"test-vectors_eris-test-vector-01.json",
@@ -99,6 +90,15 @@ func (b *BlockAccumulator) Accumulate(eblock []byte, ref [RefSize]byte, readKey
 	return nil
 }
 
+func (b BlockAccumulator) Get(ref [RefSize]byte) ([]byte, error) {
+	r := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+	v, ok := b.B[r]
+	if !ok {
+		return nil, fmt.Errorf("block accumulator does not have ref=%s", r)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(v)
+}
+
 func (b BlockAccumulator) Diff(blocks map[string]interface{}) error {
 	var err BlockDiffError
 	for k, v := range b.B {
@@ -214,11 +214,11 @@ func TestEncodeVectors(t *testing.T) {
 			if ref.Level != test.ReadCapability.Level {
 				t.Errorf("got %d, want %d", ref.Level, test.ReadCapability.Level)
 			}
-			if s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref.Ref[:]); s != test.ReadCapability.RootRef {
-				t.Errorf("got %s, want %s", s, test.ReadCapability.RootRef)
+			if ref.Ref != test.ReadCapability.RootRef {
+				t.Errorf("got %x, want %x", ref.Ref, test.ReadCapability.RootRef)
 			}
-			if s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref.Key[:]); s != test.ReadCapability.RootKey {
-				t.Errorf("got %s, want %s", s, test.ReadCapability.RootKey)
+			if ref.Key != test.ReadCapability.RootKey {
+				t.Errorf("got %x, want %x", ref.Key, test.ReadCapability.RootKey)
 			}
 			t.Logf("ref: %v", ref)
 			t.Logf("urn: %s", urn)
@@ -244,11 +244,7 @@ func TestDecodeVectors(t *testing.T) {
 			t.Errorf("error decoding content %s: %v", file, err)
 			continue
 		}
-		rootRef, err := test.ReadCapability.AsRef()
-		if err != nil {
-			t.Errorf("error decoding read capability as ref %s: %v", file, err)
-			continue
-		}
+		rootRef := test.ReadCapability.Ref()
 		t.Run(test.Name, func(t *testing.T) {
 			var buf bytes.Buffer
 			err := Decode(&test, &buf, rootRef)
@@ -264,6 +260,262 @@ func TestDecodeVectors(t *testing.T) {
 	}
 }
 
+func TestDecodeDoesNotMutateStorage(t *testing.T) {
+	b, root, content := encodeTestContent(t, 20*int(Size1KiB))
+	s := sharedBufferStorage(b)
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		if err := Decode(s, &buf, root); err != nil {
+			t.Fatalf("decode %d: got %s, want %v", i, err, nil)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("decode %d: decoded bytes do not match content", i)
+		}
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 40*int(Size1KiB))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var n int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		if n == 5 {
+			cancel()
+		}
+		return b.Get(ref)
+	})
+	err := DecodeContext(ctx, s, ioutil.Discard, root)
+	if err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if n != 5 {
+		t.Errorf("got %d fetches, want %d", n, 5)
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	got, err := DecodeBytes(&b, root, 0)
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	if _, err = DecodeBytes(&b, root, int64(len(content))); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if _, err = DecodeBytes(&b, root, int64(len(content))-1); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+}
+
+func TestDecodeBytesForgedSize(t *testing.T) {
+	// A tree of 9 blocks claiming two full subtrees of 16^7 content blocks,
+	// while holding only two.
+	b, root := tallTree(t, Size1KiB, 8)
+	if n, err := ContentSize(b, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if n < 1<<38 {
+		t.Fatalf("got %d bytes, want a claimed size of at least %d", n, int64(1)<<38)
+	}
+	got, err := DecodeBytes(b, root, 0)
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if len(got) != int(Size1KiB)+len("tall") {
+		t.Errorf("got %d bytes, want %d", len(got), int(Size1KiB)+len("tall"))
+	}
+	if _, err = DecodeBytes(b, root, 1<<20); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+}
+
+func TestDecodeRange(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	tests := []struct {
+		Name    string
+		Offset  int64
+		Length  int64
+		Fetches int
+		Err     error
+	}{
+		{
+			Name:    "within one block",
+			Offset:  33*int64(Size1KiB) + 5,
+			Length:  10,
+			Fetches: 3,
+		},
+		{
+			Name:    "spanning inner nodes",
+			Offset:  15*int64(Size1KiB) + 1000,
+			Length:  2 * int64(Size1KiB),
+			Fetches: 6,
+		},
+		{
+			Name:    "final block",
+			Offset:  int64(len(content)) - 50,
+			Length:  50,
+			Fetches: 3,
+		},
+		{
+			Name:    "everything",
+			Offset:  0,
+			Length:  int64(len(content)),
+			Fetches: 45,
+		},
+		{
+			Name:    "past the end",
+			Offset:  int64(len(content)) - 50,
+			Length:  100,
+			Fetches: 3,
+			Err:     io.ErrUnexpectedEOF,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var n int
+			s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+				n++
+				return b.Get(ref)
+			})
+			var buf bytes.Buffer
+			err := DecodeRange(s, &buf, root, test.Offset, test.Length)
+			if err != test.Err {
+				t.Errorf("got %v, want %v", err, test.Err)
+			}
+			end := test.Offset + test.Length
+			if end > int64(len(content)) {
+				end = int64(len(content))
+			}
+			if !bytes.Equal(buf.Bytes(), content[test.Offset:end]) {
+				t.Errorf("got %d bytes, want %d matching bytes", buf.Len(), end-test.Offset)
+			}
+			if n != test.Fetches {
+				t.Errorf("got %d fetches, want %d", n, test.Fetches)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 40*int(Size1KiB)+100)
+	var n int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		return b.Get(ref)
+	})
+	if err := Verify(s, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if n != 45 {
+		t.Errorf("got %d fetches, want %d", n, 45)
+	}
+	// Corrupt a content block.
+	_, corrupt, _, err := ContentBlockAt(b, root, 20)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	s = StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		eb, err := b.Get(ref)
+		if err == nil && ref == corrupt {
+			eb[10] ^= 0x01
+		}
+		return eb, err
+	})
+	err = Verify(s, root)
+	var verr VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want %T", err, verr)
+	}
+	if verr.Ref != corrupt || verr.Level != 0 {
+		t.Errorf("got level %d ref %v, want level %d ref %v", verr.Level, verr.Ref, 0, corrupt)
+	}
+	// Impossible levels are rejected before any block is fetched.
+	n = 0
+	s = StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		return b.Get(ref)
+	})
+	negative, tall := root, root
+	negative.Level = -1
+	tall.Level = math.MaxUint8
+	if err = Verify(s, negative); err == nil || errors.As(err, &verr) {
+		t.Errorf("got %v, want a level error", err)
+	}
+	if err = Verify(s, tall); !errors.Is(err, ErrLevelTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrLevelTooLarge)
+	}
+	if n != 0 {
+		t.Errorf("got %d fetches, want %d", n, 0)
+	}
+}
+
+func TestDecodeVerified(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	var buf bytes.Buffer
+	if err := DecodeVerified(b, &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// A corrupt block near the end leaves the writer untouched.
+	_, corrupt, _, err := ContentBlockAt(b, root, 38)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		eb, err := b.Get(ref)
+		if err == nil && ref == corrupt {
+			eb[10] ^= 0x01
+		}
+		return eb, err
+	})
+	buf.Reset()
+	var verr VerifyError
+	if err = DecodeVerified(s, &buf, root); !errors.As(err, &verr) {
+		t.Errorf("got %v, want %T", err, verr)
+	} else if buf.Len() != 0 {
+		t.Errorf("got %d bytes written, want %d", buf.Len(), 0)
+	}
+	// Whereas Decode writes the content before it.
+	if err = Decode(s, &buf, root); err == nil {
+		t.Errorf("got %v, want an error", err)
+	} else if buf.Len() == 0 {
+		t.Errorf("got %d bytes written, want more", buf.Len())
+	}
+}
+
+var _ StorageContext = new(contextStorage)
+
+// contextStorage blocks fetches until its context is done.
+type contextStorage struct {
+	BlockAccumulator
+	block [RefSize]byte
+}
+
+func (c contextStorage) GetContext(ctx context.Context, ref [RefSize]byte) ([]byte, error) {
+	if ref == c.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return c.Get(ref)
+}
+
+func TestDecodeStorageContext(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 40*int(Size1KiB))
+	_, block, _, err := ContentBlockAt(b, root, 4)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = DecodeContext(ctx, contextStorage{BlockAccumulator: b, block: block}, ioutil.Discard, root)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
 func getStreamingGenerator(testName string, size BlockSize, l int) (ReaderFunc, error) {
 	key := blake2b.Sum256([]byte(testName))
 	zNonce := make([]byte, chacha20.NonceSize)
@@ -374,56 +626,2534 @@ func TestStreamingEncode(t *testing.T) {
 	}
 }
 
-func BenchmarkStreamingEncode1KiB(b *testing.B) {
-	b.Logf("n=%d", b.N)
-	nBlocks := 0
-	writeFunc := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
-		nBlocks++
-		return nil
+func TestEncodeEmpty(t *testing.T) {
+	// The test vectors hold no empty content, so these URNs were computed
+	// independently of this package following the specification: a single
+	// content block consisting of only padding.
+	tests := []struct {
+		Name        string
+		BlockSize   BlockSize
+		Secret      []byte
+		ExpectedURN string
+	}{
+		{
+			Name:        "1KiB nil secret",
+			BlockSize:   Size1KiB,
+			ExpectedURN: "urn:erisx2:AAANUA46BCCYPZXVXPKWB3IUZETXSVYIM4ZPN6GADEE4VHY5HFSCKUIAEU3GOU24RRDXLJ4VWS5IE6FYK4ZNRUSLXXIDABTZT7W4XB3EPA",
+		},
+		{
+			Name:        "32KiB nil secret",
+			BlockSize:   Size32KiB,
+			ExpectedURN: "urn:erisx2:AEAKG4UANHJDSSSALCMEOL4GOFPXK4F2S3TPPKC7GGOJIOAZXXWYZLGK2FJQOMT4MUMFRPXB2QYERDMY2NTR4BF4OIR42XZBPE6KO2K2PI",
+		},
+		{
+			Name:        "1KiB null secret",
+			BlockSize:   Size1KiB,
+			Secret:      make([]byte, 32),
+			ExpectedURN: "urn:erisx2:AAADFUKDPYKJNLGCVSIIDI3FVKND7MO5AGOCXBK2C4ITT5MAL4LSCZF62B4PDOFQCLLNL7AXXSJFGINUYXVGVTDCQ2V7S7W5S234WFXCJ4",
+		},
+		{
+			Name:        "32KiB null secret",
+			BlockSize:   Size32KiB,
+			Secret:      make([]byte, 32),
+			ExpectedURN: "urn:erisx2:AEAC3MKL2BYR3E2WPMY2QRA6QZBLY4VNWJEBTSK5KWD66BRIT2EXVQVWY6TWVKJCZLC66RE3T2PKWDU3TBAKZZZIZRBTMP6BSOPE4CRXII",
+		},
 	}
-	name := fmt.Sprintf("test-%d", b.N)
-	gen, err := getStreamingGenerator(name, Size1KiB, b.N * int(Size1KiB))
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var b BlockAccumulator
+			eof := ReaderFunc(func(p []byte) (int, error) {
+				return 0, io.EOF
+			})
+			ref, err := Encode((&b).Accumulate, eof, test.Secret, test.BlockSize)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if b.N != 1 {
+				t.Errorf("got %d blocks, want %d", b.N, 1)
+			}
+			if ref.Level != 0 {
+				t.Errorf("got level %d, want %d", ref.Level, 0)
+			}
+			urn, err := ref.URN()
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if urn != test.ExpectedURN {
+				t.Errorf("got %s, want %s", urn, test.ExpectedURN)
+			}
+			var buf bytes.Buffer
+			err = Decode(b, &buf, ref)
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if buf.Len() != 0 {
+				t.Errorf("got %d decoded bytes, want %d", buf.Len(), 0)
+			}
+		})
+	}
+}
+
+func TestEncodeSingleBlock(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Length int
+		Err    bool
+	}{
+		{
+			Name:   "just under capacity",
+			Length: int(Size1KiB) - 2,
+		},
+		{
+			Name:   "exactly at capacity",
+			Length: int(Size1KiB) - 1,
+		},
+		{
+			Name:   "over capacity",
+			Length: int(Size1KiB),
+			Err:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			content := testContent(test.Length)
+			var b BlockAccumulator
+			ref, err := EncodeSingleBlock((&b).Accumulate, content, nil, Size1KiB)
+			if test.Err {
+				if err == nil {
+					t.Errorf("got %v, want error", err)
+				}
+				if b.N != 0 {
+					t.Errorf("got %d blocks, want %d", b.N, 0)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if b.N != 1 {
+				t.Errorf("got %d blocks, want %d", b.N, 1)
+			}
+			want, err := Encode1KiB(func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }, bytes.NewReader(content), nil)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if ref != want {
+				t.Errorf("got %v, want %v", ref, want)
+			}
+		})
+	}
+}
+
+func TestDecodeLevelZero(t *testing.T) {
+	for _, size := range []BlockSize{Size1KiB, Size32KiB} {
+		for _, n := range []int{0, 1, 100, int(size) - 1} {
+			t.Run(fmt.Sprintf("%d/%d", size, n), func(t *testing.T) {
+				content := testContent(n)
+				var b BlockAccumulator
+				root, err := Encode((&b).Accumulate, bytes.NewReader(content), nil, size)
+				if err != nil {
+					t.Fatalf("got %s, want %v", err, nil)
+				} else if root.Level != 0 {
+					t.Fatalf("got level %d, want %d", root.Level, 0)
+				} else if b.N != 1 {
+					t.Fatalf("got %d blocks, want %d", b.N, 1)
+				}
+				var gets int
+				s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+					gets++
+					return b.Get(ref)
+				})
+				var buf bytes.Buffer
+				if err = Decode(s, &buf, root); err != nil {
+					t.Fatalf("got %s, want %v", err, nil)
+				} else if !bytes.Equal(buf.Bytes(), content) {
+					t.Errorf("got %d decoded bytes, want %d", buf.Len(), n)
+				} else if gets != 1 {
+					t.Errorf("got %d fetches, want %d", gets, 1)
+				}
+			})
+		}
+	}
+	// The padding sink strips the padding of a lone block written once.
+	var buf bytes.Buffer
+	sink := newPaddingSink(&buf, Size1KiB)
+	if _, err := sink.Write(padContentBlock(ubytes("lone"), Size1KiB)); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if buf.Len() != 0 {
+		t.Errorf("got %d bytes written before Flush, want %d", buf.Len(), 0)
+	}
+	if n, err := sink.Flush(); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if n != 4 || buf.String() != "lone" {
+		t.Errorf("got %d bytes %q, want %q", n, buf.String(), "lone")
+	}
+}
+
+func TestSelfTestSecret(t *testing.T) {
+	if err := SelfTestSecret(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	tampered := []byte(selfTestSecretURN)
+	tampered[len(tampered)-1] = 'A'
+	if err := selfTestSecret(string(tampered)); err == nil {
+		t.Errorf("got %v, want error", err)
+	}
+}
+
+func TestRefBinary(t *testing.T) {
+	for _, file := range files {
+		b, err := ioutil.ReadFile("./testdata/" + file)
+		if err != nil {
+			t.Errorf("error reading %s: %v", file, err)
+			continue
+		}
+		var test TestVector
+		err = json.Unmarshal(b, &test)
+		if err != nil {
+			t.Errorf("error unmarshalling %s: %v", file, err)
+			continue
+		}
+		ref := test.ReadCapability.Ref()
+		t.Run(test.Name, func(t *testing.T) {
+			bb, err := ref.MarshalBinary()
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if len(bb) != 66 {
+				t.Errorf("got %d bytes, want %d", len(bb), 66)
+			}
+			if rc, err := ref.ReadCapability(); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(rc, bb) {
+				t.Errorf("read capability does not match binary marshalling")
+			}
+			// The URN is the base32 of the binary read capability.
+			want := "urn:erisx2:" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bb)
+			if want != test.URN {
+				t.Errorf("got %s, want %s", want, test.URN)
+			}
+			var got Ref
+			if err = got.UnmarshalBinary(bb); err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if got != ref {
+				t.Errorf("got %v, want %v", got, ref)
+			}
+			if err = got.UnmarshalBinary(bb[:65]); err == nil {
+				t.Errorf("got %v, want error for truncated capability", err)
+			}
+			bb[0] = 2
+			if err = got.UnmarshalBinary(bb); err == nil {
+				t.Errorf("got %v, want error for unhandled block size", err)
+			}
+		})
+	}
+}
+
+func TestRefString(t *testing.T) {
+	ref := Ref{
+		BlockSize: Size1KiB,
+		Level:     1,
+	}
+	ref.Ref[0] = 0xAB
+	urn, err := ref.URN()
 	if err != nil {
-		b.Errorf("error creating generator: %v", err)
-		return
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if s := ref.String(); s != urn {
+		t.Errorf("got %s, want %s", s, urn)
 	}
+	ref.Level = 256
+	want := "erisref(level=256, size=1024, ab00000000000000)"
+	if s := fmt.Sprintf("%v", ref); s != want {
+		t.Errorf("got %s, want %s", s, want)
+	}
+}
 
-	b.ResetTimer()
-	ref, err := Encode1KiB(writeFunc, gen, nil)
+func TestRefEncode(t *testing.T) {
+	ref := Ref{
+		BlockSize: Size32KiB,
+		Level:     2,
+	}
+	ref.Ref[0] = 0xAB
+	ref.Key[KeySize-1] = 0xCD
+	bin, err := ref.ReadCapability()
 	if err != nil {
-		b.Errorf("got %s, want %v", err, nil)
+		t.Fatalf("got %s, want %v", err, nil)
 	}
 	urn, err := ref.URN()
 	if err != nil {
-		b.Errorf("got %s, want %v", err, nil)
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, test := range []struct {
+		Name     string
+		Encoding Encoding
+		Want     string
+	}{
+		{"default", nil, strings.TrimPrefix(urn, "urn:erisx2:")},
+		{"hex", HexEncoding, hex.EncodeToString(bin)},
+		{"base64url", base64.RawURLEncoding, base64.RawURLEncoding.EncodeToString(bin)},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := ref.Encode(test.Encoding)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if got != test.Want {
+				t.Errorf("got %s, want %s", got, test.Want)
+			}
+		})
+	}
+	ref.Level = 256
+	if _, err = ref.Encode(HexEncoding); !errors.Is(err, ErrLevelTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrLevelTooLarge)
 	}
-	b.Logf("ref=%s", urn)
-	b.Logf("number of blocks: %d", nBlocks)
 }
 
-func BenchmarkStreamingEncode32KiB(b *testing.B) {
-	b.Logf("n=%d", b.N)
-	nBlocks := 0
-	writeFunc := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
-		nBlocks++
-		return nil
+func TestRefEqual(t *testing.T) {
+	a := Ref{
+		BlockSize: Size1KiB,
+		Level:     1,
 	}
-	name := fmt.Sprintf("test-%d", b.N)
-	gen, err := getStreamingGenerator(name, Size32KiB, b.N * int(Size1KiB))
-	if err != nil {
-		b.Errorf("error creating generator: %v", err)
-		return
+	a.Ref[0] = 1
+	a.Key[0] = 2
+	if !a.Equal(a) {
+		t.Errorf("got %v, want %v", false, true)
+	}
+	for _, mod := range []func(r *Ref){
+		func(r *Ref) { r.BlockSize = Size32KiB },
+		func(r *Ref) { r.Level = 2 },
+		func(r *Ref) { r.Ref[RefSize-1] = 1 },
+		func(r *Ref) { r.Key[KeySize-1] = 1 },
+	} {
+		b := a
+		mod(&b)
+		if a.Equal(b) {
+			t.Errorf("got %v, want %v for %v and %v", true, false, a, b)
+		}
 	}
+}
 
-	b.ResetTimer()
-	ref, err := Encode32KiB(writeFunc, gen, nil)
+func TestEncodeBlockSizes(t *testing.T) {
+	content := testContent(100 * int(kb))
+	noop := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	for _, size := range []BlockSize{4 * kb, 64 * kb} {
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			var n int
+			w := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+				n++
+				if len(eblock) != int(size) {
+					t.Errorf("got block of %d bytes, want %d", len(eblock), size)
+				}
+				return nil
+			}
+			ref, err := Encode(w, bytes.NewReader(content), nil, size)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if ref.BlockSize != size {
+				t.Errorf("got %d, want %d", ref.BlockSize, size)
+			}
+			if n == 0 {
+				t.Errorf("got %d blocks, want more", n)
+			}
+		})
+	}
+	want, err := Encode1KiB(noop, bytes.NewReader(content), nil)
 	if err != nil {
-		b.Errorf("got %s, want %v", err, nil)
+		t.Fatalf("got %s, want %v", err, nil)
 	}
-	urn, err := ref.URN()
+	got, err := Encode(noop, bytes.NewReader(content), nil, Size1KiB)
 	if err != nil {
-		b.Errorf("got %s, want %v", err, nil)
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, size := range []BlockSize{0, -1024, 64, 1000} {
+		if _, err := Encode(noop, bytes.NewReader(content), nil, size); err == nil {
+			t.Errorf("got %v, want error for block size %d", err, size)
+		}
+	}
+}
+
+func TestEncodeBytes(t *testing.T) {
+	content := testContent(3*int(Size32KiB) + 7)
+	noop := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	for _, size := range []BlockSize{Size1KiB, Size32KiB} {
+		want, err := Encode(noop, bytes.NewReader(content), nil, size)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		got, err := EncodeBytes(noop, content, nil, size)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		} else if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if _, err := EncodeBytes(noop, content, nil, 4*kb); err == nil {
+		t.Errorf("got %v, want error for unhandled block size", err)
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var n int
+	w := func([]byte, [RefSize]byte, [KeySize]byte) error {
+		n++
+		if n == 3 {
+			cancel()
+		}
+		return nil
+	}
+	gen, err := getStreamingGenerator(t.Name(), Size1KiB, 100*int(Size1KiB))
+	if err != nil {
+		t.Fatalf("error creating generator: %v", err)
+	}
+	_, err = EncodeContext(ctx, w, gen, nil, Size1KiB)
+	if err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if n != 3 {
+		t.Errorf("got %d blocks, want %d", n, 3)
+	}
+}
+
+func TestEncodeStats(t *testing.T) {
+	tests := []struct {
+		File  string
+		Stats Stats
+	}{
+		{
+			File: "test-vectors_eris-test-vector-00.json",
+			Stats: Stats{
+				Blocks:        1,
+				ContentBlocks: 1,
+				InnerBlocks:   0,
+				Depth:         0,
+				BytesRead:     10,
+			},
+		},
+		{
+			File: "test-vectors_eris-test-vector-11.json",
+			Stats: Stats{
+				Blocks:        1096,
+				ContentBlocks: 1025,
+				InnerBlocks:   71,
+				Depth:         3,
+				BytesRead:     1048576,
+			},
+		},
+		{
+			File: "test-vectors_eris-test-vector-13.json",
+			Stats: Stats{
+				Blocks:        3,
+				ContentBlocks: 2,
+				InnerBlocks:   1,
+				Depth:         1,
+				BytesRead:     1024,
+			},
+		},
+	}
+	for _, test := range tests {
+		b, err := ioutil.ReadFile("./testdata/" + test.File)
+		if err != nil {
+			t.Errorf("error reading %s: %v", test.File, err)
+			continue
+		}
+		var tv TestVector
+		err = json.Unmarshal(b, &tv)
+		if err != nil {
+			t.Errorf("error unmarshalling %s: %v", test.File, err)
+			continue
+		}
+		bcon, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(tv.Content)
+		if err != nil {
+			t.Errorf("error decoding content %s: %v", test.File, err)
+			continue
+		}
+		bconv, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(tv.ConvergenceSecret)
+		if err != nil {
+			t.Errorf("error decoding convergence secret %s: %v", test.File, err)
+			continue
+		}
+		t.Run(tv.Name, func(t *testing.T) {
+			var acc BlockAccumulator
+			ref, st, err := EncodeStats((&acc).Accumulate, bytes.NewReader(bcon), bconv, tv.BlockSize)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if st != test.Stats {
+				t.Errorf("got %+v, want %+v", st, test.Stats)
+			}
+			if st.Blocks != acc.N {
+				t.Errorf("got %d, want %d", st.Blocks, acc.N)
+			}
+			if urn, _ := ref.URN(); urn != tv.URN {
+				t.Errorf("got %s, want %s", urn, tv.URN)
+			}
+		})
+	}
+}
+
+func TestEncoderDedup(t *testing.T) {
+	// Identical null content blocks, along with a final padding block.
+	content := make([]byte, 20*int(Size1KiB))
+	tests := []struct {
+		Name   string
+		Dedup  bool
+		Blocks int
+	}{
+		{
+			Name:   "without dedup",
+			Blocks: 24,
+		},
+		{
+			Name:   "with dedup",
+			Dedup:  true,
+			Blocks: 5,
+		},
+	}
+	var refs []Ref
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var n int
+			var acc BlockAccumulator
+			w := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+				n++
+				return acc.Accumulate(eblock, ref, readkey)
+			}
+			e := NewEncoder(w, nil, Size1KiB)
+			e.Dedup = test.Dedup
+			ref, err := e.Encode(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if n != test.Blocks {
+				t.Errorf("got %d blocks, want %d", n, test.Blocks)
+			}
+			var buf bytes.Buffer
+			if err = Decode(acc, &buf, ref); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("decoded bytes do not match content")
+			}
+			refs = append(refs, ref)
+		})
+	}
+	if len(refs) == 2 && refs[0] != refs[1] {
+		t.Errorf("got %v, want %v", refs[1], refs[0])
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		Length int
+		Secret []byte
+		Size   BlockSize
+	}{
+		{Length: 40*int(Size1KiB) + 100, Size: Size1KiB},
+		{Length: 10, Size: Size1KiB},
+		{Length: 300 * int(Size1KiB), Secret: secret, Size: Size1KiB},
+		{Length: 3 * int(Size1KiB), Size: Size1KiB},
+		{Length: 3*int(Size32KiB) + 1, Size: Size32KiB},
+		{Length: 20 * int(Size1KiB), Secret: secret, Size: Size1KiB},
+	}
+	e := NewEncoder(nil, nil, Size1KiB)
+	for i, test := range tests {
+		content := testContent(test.Length)
+		var want, got BlockAccumulator
+		wantRef, err := NewEncoder((&want).Accumulate, test.Secret, test.Size).Encode(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%d: got %s, want %v", i, err, nil)
+		}
+		e.Reset((&got).Accumulate, test.Secret, test.Size)
+		gotRef, err := e.Encode(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%d: got %s, want %v", i, err, nil)
+		}
+		if gotRef != wantRef {
+			t.Errorf("%d: got %v, want %v", i, gotRef, wantRef)
+		}
+		if want.N != got.N {
+			t.Errorf("%d: got %d blocks, want %d", i, got.N, want.N)
+		}
+	}
+}
+
+func TestPadContentBlock(t *testing.T) {
+	for _, n := range []int{0, 1, int(Size1KiB) - 1, int(Size1KiB)} {
+		block := make([]byte, n, 2*Size1KiB)
+		for i := range block {
+			block[i] = 0xFF
+		}
+		p := padContentBlock(block, Size1KiB)
+		if len(p)%int(Size1KiB) != 0 || len(p) <= n {
+			t.Errorf("%d: got padded length %d", n, len(p))
+			continue
+		}
+		if p[n] != 0x80 {
+			t.Errorf("%d: got %x, want %x", n, p[n], 0x80)
+		}
+		for i := n + 1; i < len(p); i++ {
+			if p[i] != 0 {
+				t.Errorf("%d: got %x at %d, want %x", n, p[i], i, 0)
+				break
+			}
+		}
+	}
+	buf := make([]byte, Size32KiB)
+	allocs := testing.AllocsPerRun(100, func() {
+		padContentBlock(buf[:100], Size32KiB)
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations, want %v", allocs, 0)
+	}
+}
+
+func BenchmarkPadContentBlock(b *testing.B) {
+	buf := make([]byte, Size32KiB)
+	b.ReportAllocs()
+	b.SetBytes(int64(Size32KiB))
+	for i := 0; i < b.N; i++ {
+		padContentBlock(buf[:100], Size32KiB)
+	}
+}
+
+func BenchmarkAccumulatorReset(b *testing.B) {
+	for _, size := range []BlockSize{Size1KiB, Size32KiB} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			acc, err := newAccumulator(primitives{}, nil, size, nil, 1, nil)
+			if err != nil {
+				b.Fatalf("got %s, want %v", err, nil)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				acc.N = int(size)
+				acc.reset()
+			}
+		})
+	}
+}
+
+// BenchmarkAccumulateDeepTree accumulates reference-key pairs into a tree of
+// inner nodes, which resets an accumulator each time an inner node is emitted.
+func BenchmarkAccumulateDeepTree(b *testing.B) {
+	for _, size := range []BlockSize{Size1KiB, Size32KiB} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			discard := func([]byte, [RefSize]byte, [KeySize]byte, int) error { return nil }
+			acc, err := newAccumulator(primitives{}, discard, size, nil, 1, nil)
+			if err != nil {
+				b.Fatalf("got %s, want %v", err, nil)
+			}
+			var ref [RefSize]byte
+			var key [KeySize]byte
+			ref[0] = 1
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err = acc.RecurAccumulate(ref, key); err != nil {
+					b.Fatalf("got %s, want %v", err, nil)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStreamingEncode1KiB(b *testing.B) {
+	b.Logf("n=%d", b.N)
+	nBlocks := 0
+	writeFunc := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+		nBlocks++
+		return nil
+	}
+	name := fmt.Sprintf("test-%d", b.N)
+	gen, err := getStreamingGenerator(name, Size1KiB, b.N * int(Size1KiB))
+	if err != nil {
+		b.Errorf("error creating generator: %v", err)
+		return
+	}
+
+	b.ResetTimer()
+	ref, err := Encode1KiB(writeFunc, gen, nil)
+	if err != nil {
+		b.Errorf("got %s, want %v", err, nil)
+	}
+	urn, err := ref.URN()
+	if err != nil {
+		b.Errorf("got %s, want %v", err, nil)
+	}
+	b.Logf("ref=%s", urn)
+	b.Logf("number of blocks: %d", nBlocks)
+}
+
+func BenchmarkStreamingEncode32KiB(b *testing.B) {
+	b.Logf("n=%d", b.N)
+	nBlocks := 0
+	writeFunc := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+		nBlocks++
+		return nil
+	}
+	name := fmt.Sprintf("test-%d", b.N)
+	gen, err := getStreamingGenerator(name, Size32KiB, b.N * int(Size1KiB))
+	if err != nil {
+		b.Errorf("error creating generator: %v", err)
+		return
+	}
+
+	b.ResetTimer()
+	ref, err := Encode32KiB(writeFunc, gen, nil)
+	if err != nil {
+		b.Errorf("got %s, want %v", err, nil)
+	}
+	urn, err := ref.URN()
+	if err != nil {
+		b.Errorf("got %s, want %v", err, nil)
+	}
+	b.Logf("ref=%s", urn)
+	b.Logf("number of blocks: %d", nBlocks)
+}
+
+var _ BatchStorage = new(batchStorage)
+
+// batchStorage counts the calls made to fetch blocks.
+type batchStorage struct {
+	BlockAccumulator
+	gets, batches int
+}
+
+func (b *batchStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	b.gets++
+	return b.BlockAccumulator.Get(ref)
+}
+
+func (b *batchStorage) GetMany(refs [][RefSize]byte) ([][]byte, error) {
+	b.batches++
+	blocks := make([][]byte, len(refs))
+	for i, ref := range refs {
+		eb, err := b.BlockAccumulator.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = eb
+	}
+	return blocks, nil
+}
+
+func TestDecodeBatchStorage(t *testing.T) {
+	content := testContent(40 * int(Size1KiB))
+	b := &batchStorage{}
+	root, err := Encode1KiB((&b.BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var buf bytes.Buffer
+	if err = Decode(b, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// Only the root is fetched alone. The children of the root and of its
+	// three level 1 inner nodes are each fetched in one batch.
+	if b.gets != 1 {
+		t.Errorf("got %d calls to Get, want %d", b.gets, 1)
+	} else if b.batches != 4 {
+		t.Errorf("got %d calls to GetMany, want %d", b.batches, 4)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(10*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	m := NewMemStorage()
+	eb, ref, key, err := marshalBlock(make(ubytes, Size1KiB), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	m.Put(eb, ref)
+	unpadded := Ref{BlockSize: Size1KiB, Ref: ref, Key: key}
+	corrupted := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		eb, err := b.Get(ref)
+		if err == nil {
+			eb[0] ^= 0xFF
+		}
+		return eb, err
+	})
+	tests := []struct {
+		Name string
+		Err  error
+		Want error
+	}{
+		{
+			Name: "unhandled block size",
+			Err:  Decode(b, ioutil.Discard, Ref{BlockSize: 2 * Size1KiB}),
+			Want: ErrUnhandledBlockSize,
+		},
+		{
+			Name: "block size multiple",
+			Err: func() error {
+				_, err := Encode(b.Accumulate, bytes.NewReader(nil), nil, 200)
+				return err
+			}(),
+			Want: ErrBlockSizeMultiple,
+		},
+		{
+			Name: "block size too small",
+			Err: func() error {
+				_, err := Encode(b.Accumulate, bytes.NewReader(nil), nil, RefSize+KeySize)
+				return err
+			}(),
+			Want: ErrBlockSizeTooSmall,
+		},
+		{
+			Name: "level too large",
+			Err: func() error {
+				_, err := Ref{BlockSize: Size1KiB, Level: 256}.URN()
+				return err
+			}(),
+			Want: ErrLevelTooLarge,
+		},
+		{
+			Name: "bad padding",
+			Err:  Decode(m, ioutil.Discard, unpadded),
+			Want: ErrBadPadding,
+		},
+		{
+			Name: "ref mismatch",
+			Err:  Decode(corrupted, ioutil.Discard, root),
+			Want: ErrRefMismatch,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if !errors.Is(test.Err, test.Want) {
+				t.Errorf("got %v, want %v", test.Err, test.Want)
+			}
+		})
+	}
+}
+
+func TestRefMismatchError(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(100)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var corrupt [RefSize]byte
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		eb, err := b.Get(ref)
+		if err == nil {
+			eb[0] ^= 0xFF
+			corrupt = toRef(eb)
+		}
+		return eb, err
+	})
+	err = Decode(s, ioutil.Discard, root)
+	var rm RefMismatchError
+	if !errors.As(err, &rm) {
+		t.Fatalf("got %v, want a RefMismatchError", err)
+	}
+	if rm.Expected != root.Ref {
+		t.Errorf("got expected ref %v, want %v", rm.Expected, root.Ref)
+	}
+	if rm.Got != corrupt {
+		t.Errorf("got actual ref %v, want %v", rm.Got, corrupt)
+	}
+	if rm.Size != Size1KiB {
+		t.Errorf("got size %d, want %d", rm.Size, Size1KiB)
+	}
+}
+
+func TestVerifyBlock(t *testing.T) {
+	var ref [RefSize]byte
+	var eblock []byte
+	_, err := Encode1KiB(func(eb []byte, r [RefSize]byte, _ [KeySize]byte) error {
+		eblock, ref = eb, r
+		return nil
+	}, bytes.NewReader(testContent(100)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if err = VerifyBlock(eblock, ref, Size1KiB); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if err = VerifyBlock(eblock[:len(eblock)-1], ref, Size1KiB); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+	if err = VerifyBlock(eblock, ref, Size32KiB); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+	if err = VerifyBlock(eblock, ref, BlockSize(100)); !errors.Is(err, ErrUnhandledBlockSize) {
+		t.Errorf("got %v, want %v", err, ErrUnhandledBlockSize)
+	}
+	corrupt := append([]byte(nil), eblock...)
+	corrupt[0] ^= 0xFF
+	var rm RefMismatchError
+	if err = VerifyBlock(corrupt, ref, Size1KiB); !errors.As(err, &rm) {
+		t.Fatalf("got %v, want a RefMismatchError", err)
+	} else if rm.Expected != ref || rm.Got != BlockRef(corrupt) {
+		t.Errorf("got %v, want expected %x and got %x", rm, ref, BlockRef(corrupt))
+	}
+}
+
+func TestBadPaddingError(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Block []byte
+		Want  BadPaddingError
+	}{
+		{
+			Name:  "missing marker",
+			Block: make([]byte, 16),
+			Want:  BadPaddingError{MissingMarker: true},
+		},
+		{
+			Name:  "non-zero byte after marker",
+			Block: []byte{'a', 0x80, 0, 0, 'b', 0, 0, 0},
+			Want:  BadPaddingError{Offset: 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := unpad(test.Block)
+			var bp BadPaddingError
+			if !errors.As(err, &bp) {
+				t.Fatalf("got %v, want a BadPaddingError", err)
+			} else if bp != test.Want {
+				t.Errorf("got %+v, want %+v", bp, test.Want)
+			}
+			if !errors.Is(err, ErrBadPadding) {
+				t.Errorf("got %v, want %v", err, ErrBadPadding)
+			}
+		})
+	}
+}
+
+func TestEncryptDecryptTo(t *testing.T) {
+	var key [KeySize]byte
+	copy(key[:], "encrypt to decrypt to test key!!")
+	plain := testContent(int(Size1KiB))
+	orig := append([]byte(nil), plain...)
+	eb, err := encryptTo(make([]byte, len(plain)), plain, key)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(plain, orig) {
+		t.Errorf("encryptTo modified the plaintext")
+	}
+	encrypted := append([]byte(nil), eb...)
+	ub, err := decryptTo(make([]byte, 2*len(eb)), eb, key)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(eb, encrypted) {
+		t.Errorf("decryptTo modified the encrypted block")
+	} else if !bytes.Equal(ub, orig) {
+		t.Errorf("decrypted bytes do not match plaintext")
+	}
+	// The in-place variants agree with the non-mutating ones.
+	ip, err := encrypt(append(ubytes(nil), orig...), key)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(ip, encrypted) {
+		t.Errorf("in-place encrypted bytes do not match")
+	}
+	if _, err = decryptTo(make([]byte, 10), eb, key); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	var gets int
+	pool := &sync.Pool{
+		New: func() interface{} {
+			gets++
+			return make([]byte, Size1KiB)
+		},
+	}
+	var b BlockAccumulator
+	e := NewEncoder((&b).Accumulate, nil, Size1KiB)
+	e.Pool = pool
+	root, err := e.Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	want, err := Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !root.Equal(want) {
+		t.Errorf("got %v, want %v", root, want)
+	}
+	d := &Decoder{Pool: pool}
+	var buf bytes.Buffer
+	if err = d.Decode(sharedBufferStorage(b), &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	if gets == 0 {
+		t.Errorf("got %d buffers from the pool, want at least %d", gets, 1)
+	}
+}
+
+// TestEncoderPerGoroutine ensures that concurrent encoding with one Encoder per
+// goroutine, sharing a Pool and a Storage, is free of data races when run with
+// -race.
+func TestEncoderPerGoroutine(t *testing.T) {
+	pool := &sync.Pool{}
+	s := NewMemStorage()
+	contents := make([][]byte, 8)
+	want := make([]Ref, len(contents))
+	for i := range contents {
+		contents[i] = testContent((i + 1) * 5 * int(Size1KiB))
+		var err error
+		want[i], err = Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(contents[i]), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	got := make([][]Ref, 4)
+	var wg sync.WaitGroup
+	for g := range got {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			e := NewEncoder(s.WriteFunc, nil, Size1KiB)
+			e.Pool = pool
+			for _, c := range contents {
+				// Reuse the Encoder for every content.
+				e.Reset(s.WriteFunc, nil, Size1KiB)
+				root, err := e.Encode(bytes.NewReader(c))
+				if err != nil {
+					t.Errorf("got %s, want %v", err, nil)
+					return
+				}
+				got[g] = append(got[g], root)
+			}
+		}(g)
+	}
+	wg.Wait()
+	for g := range got {
+		if len(got[g]) != len(want) {
+			continue
+		}
+		for i := range want {
+			if !got[g][i].Equal(want[i]) {
+				t.Errorf("goroutine %d content %d: got %v, want %v", g, i, got[g][i], want[i])
+			}
+		}
+	}
+}
+
+var _ HashProvider = sha256Hash{}
+
+// sha256Hash is an alternative HashProvider using HMAC-SHA256 and SHA256.
+type sha256Hash struct{}
+
+func (sha256Hash) NewKeyedHash(secret []byte) (hash.Hash, error) {
+	return hmac.New(sha256.New, secret), nil
+}
+
+func (sha256Hash) RefHash(eblock []byte) [RefSize]byte {
+	return sha256.Sum256(eblock)
+}
+
+func TestHashProvider(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	want, err := Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var b BlockAccumulator
+	e := NewEncoder((&b).Accumulate, nil, Size1KiB)
+	e.Hash = sha256Hash{}
+	root, err := e.Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if root.Equal(want) {
+		t.Errorf("got the default root for an alternative hash provider")
+	}
+	if urn, _ := root.URN(); !strings.HasPrefix(urn, "urn:"+erisURNVersion+":") {
+		t.Errorf("got %s, want the prefix %s", urn, "urn:"+erisURNVersion+":")
+	}
+	d := &Decoder{Hash: sha256Hash{}}
+	var buf bytes.Buffer
+	if err = d.Decode(b, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	if err = Decode(b, ioutil.Discard, root); !errors.Is(err, ErrRefMismatch) {
+		t.Errorf("got %v, want %v", err, ErrRefMismatch)
+	}
+}
+
+var _ CipherProvider = aesCipher{}
+
+// aesCipher is an alternative CipherProvider using AES-256 in CTR mode.
+type aesCipher struct{}
+
+func (aesCipher) NewStream(key [KeySize]byte) (cipher.Stream, error) {
+	b, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(b, make([]byte, aes.BlockSize)), nil
+}
+
+func TestCipherProvider(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	want, err := Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var b BlockAccumulator
+	e := NewEncoder((&b).Accumulate, nil, Size1KiB)
+	e.Cipher = aesCipher{}
+	root, err := e.Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if root.Equal(want) {
+		t.Errorf("got the default root for an alternative cipher provider")
+	}
+	d := &Decoder{Cipher: aesCipher{}}
+	var buf bytes.Buffer
+	if err = d.Decode(b, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// Blocks still match their references, but decrypt to garbage.
+	if err = Decode(b, ioutil.Discard, root); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+var _ Padder = markerPadder(0)
+
+// markerPadder is an alternative Padder, padding with its marker byte instead
+// of 0x80.
+type markerPadder byte
+
+func (m markerPadder) Pad(buf []byte, size BlockSize) []byte {
+	b := padContentBlock(buf, size)
+	b[len(buf)] = byte(m)
+	return b
+}
+
+func (m markerPadder) Unpad(buf []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(buf, byte(m))
+	if i < 0 || len(bytes.Trim(buf[i+1:], "\x00")) > 0 {
+		return nil, BadPaddingError{MissingMarker: true}
+	}
+	return buf[:i], nil
+}
+
+// splitPadder is an alternative Padder appending a whole block of zeros after
+// the content padded with ISO/IEC 7816-4. It only encodes.
+type splitPadder struct{}
+
+func (splitPadder) Pad(buf []byte, size BlockSize) []byte {
+	return append(padContentBlock(buf, size), make([]byte, size)...)
+}
+
+func (splitPadder) Unpad(buf []byte) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+// shortPadder is a broken Padder, never padding the content.
+type shortPadder struct{}
+
+func (shortPadder) Pad(buf []byte, size BlockSize) []byte {
+	return buf
+}
+
+func (shortPadder) Unpad(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func TestPadder(t *testing.T) {
+	for _, length := range []int{0, 100, int(Size1KiB), 40*int(Size1KiB) + 100} {
+		content := testContent(length)
+		want, err := Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		// The default Padder does not change the encoding.
+		e := NewEncoder(new(BlockAccumulator).Accumulate, nil, Size1KiB)
+		e.Padder = ISO7816{}
+		if root, err := e.Encode(bytes.NewReader(content)); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		} else if !root.Equal(want) {
+			t.Errorf("%d: got %v, want %v", length, root, want)
+		}
+		for _, workers := range []int{1, 4} {
+			var b BlockAccumulator
+			e = NewEncoder((&b).Accumulate, nil, Size1KiB)
+			e.Padder = markerPadder(0x01)
+			e.Workers = workers
+			root, err := e.Encode(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if root.Equal(want) {
+				t.Errorf("%d: got the default root for an alternative padder", length)
+			}
+			d := &Decoder{Padder: markerPadder(0x01), Strict: true}
+			var buf bytes.Buffer
+			if err = d.Decode(b, &buf, root); err != nil {
+				t.Errorf("%d: got %s, want %v", length, err, nil)
+			} else if !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("%d: decoded bytes do not match content", length)
+			}
+			var bpe BadPaddingError
+			if err = Decode(b, ioutil.Discard, root); !errors.As(err, &bpe) {
+				t.Errorf("%d: got %v, want a BadPaddingError", length, err)
+			}
+		}
+	}
+}
+
+func TestPadderSplit(t *testing.T) {
+	content := testContent(3*int(Size1KiB) + 100)
+	var want BlockAccumulator
+	wantRef, err := Encode1KiB((&want).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, workers := range []int{1, 4} {
+		var b BlockAccumulator
+		e := NewEncoder((&b).Accumulate, nil, Size1KiB)
+		e.Padder = splitPadder{}
+		e.Workers = workers
+		root, err := e.Encode(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		} else if root.Equal(wantRef) {
+			t.Errorf("got the default root for an alternative padder")
+		} else if len(b.B) != len(want.B)+1 {
+			t.Errorf("got %d blocks, want %d", len(b.B), len(want.B)+1)
+		}
+	}
+	// A Padder must pad to whole blocks.
+	for _, workers := range []int{1, 4} {
+		e := NewEncoder(new(BlockAccumulator).Accumulate, nil, Size1KiB)
+		e.Padder = shortPadder{}
+		e.Workers = workers
+		if _, err = e.Encode(bytes.NewReader(content)); !errors.Is(err, ErrBlockLength) {
+			t.Errorf("got %v, want %v", err, ErrBlockLength)
+		}
+	}
+}
+
+func TestEncoderLevel(t *testing.T) {
+	content := testContent(300 * int(Size1KiB))
+	var b BlockAccumulator
+	levels := make(map[[RefSize]byte]int)
+	w := func(eblock []byte, ref [RefSize]byte, readkey [KeySize]byte, level int) error {
+		levels[ref] = level
+		return b.Accumulate(eblock, ref, readkey)
+	}
+	root, err := NewEncoderLevel(w, nil, Size1KiB).Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if root.Level != 3 {
+		t.Fatalf("got level %d, want %d", root.Level, 3)
+	}
+	walked := make(map[[RefSize]byte]struct{})
+	err = WalkRefs(b, root, func(ref [RefSize]byte, level int) error {
+		walked[ref] = struct{}{}
+		if l, ok := levels[ref]; !ok {
+			t.Errorf("block at level %d was not written", level)
+		} else if l != level {
+			t.Errorf("got level %d, want %d", l, level)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if len(walked) != len(levels) {
+		t.Errorf("got %d blocks written, want %d", len(levels), len(walked))
+	}
+}
+
+func TestDecoderOnProgress(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	var b BlockAccumulator
+	root, st, err := EncodeStats((&b).Accumulate, bytes.NewReader(content), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var calls int
+	var lastBytes int64
+	var lastBlocks int
+	d := &Decoder{
+		OnProgress: func(bytesWritten int64, blocksFetched int) {
+			calls++
+			if bytesWritten < lastBytes || blocksFetched < lastBlocks {
+				t.Errorf("progress went backwards: got (%d, %d) after (%d, %d)", bytesWritten, blocksFetched, lastBytes, lastBlocks)
+			}
+			lastBytes, lastBlocks = bytesWritten, blocksFetched
+		},
+	}
+	var buf bytes.Buffer
+	if err = d.Decode(b, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if calls != st.ContentBlocks+1 {
+		t.Errorf("got %d calls, want %d", calls, st.ContentBlocks+1)
+	}
+	if lastBytes != int64(len(content)) {
+		t.Errorf("got %d bytes written, want %d", lastBytes, len(content))
+	}
+	if lastBlocks != st.Blocks {
+		t.Errorf("got %d blocks fetched, want %d", lastBlocks, st.Blocks)
+	}
+}
+
+func TestDecoderMaxLevel(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(300*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if root.Level != 3 {
+		t.Fatalf("got level %d, want %d", root.Level, 3)
+	}
+	fetches := 0
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		fetches++
+		return b.Get(ref)
+	})
+	tests := []struct {
+		Name     string
+		MaxLevel int
+		Level    int
+		Size     BlockSize
+		Want     error
+	}{
+		{
+			Name:  "unlimited",
+			Level: 3,
+			Size:  Size1KiB,
+		},
+		{
+			Name:     "within maximum",
+			MaxLevel: 3,
+			Level:    3,
+			Size:     Size1KiB,
+		},
+		{
+			Name:     "exceeds maximum",
+			MaxLevel: 2,
+			Level:    3,
+			Size:     Size1KiB,
+			Want:     ErrLevelTooLarge,
+		},
+		{
+			Name:  "impossible 1KiB level",
+			Level: 15,
+			Size:  Size1KiB,
+			Want:  ErrLevelTooLarge,
+		},
+		{
+			Name:  "impossible 32KiB level",
+			Level: 7,
+			Size:  Size32KiB,
+			Want:  ErrLevelTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			fetches = 0
+			r := root
+			r.Level = test.Level
+			r.BlockSize = test.Size
+			d := &Decoder{MaxLevel: test.MaxLevel}
+			err := d.Decode(s, ioutil.Discard, r)
+			if test.Want == nil && err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if test.Want != nil {
+				if !errors.Is(err, test.Want) {
+					t.Errorf("got %v, want %v", err, test.Want)
+				} else if fetches != 0 {
+					t.Errorf("got %d fetches, want %d", fetches, 0)
+				}
+			}
+		})
+	}
+	if l := maxTreeLevel(Size1KiB); l != 14 {
+		t.Errorf("got %d, want %d", l, 14)
+	}
+	if l := maxTreeLevel(Size32KiB); l != 6 {
+		t.Errorf("got %d, want %d", l, 6)
+	}
+}
+
+func TestDecoderMaxBlocks(t *testing.T) {
+	var b BlockAccumulator
+	root, st, err := EncodeStats((&b).Accumulate, bytes.NewReader(testContent(40*int(Size1KiB))), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	batch := &batchStorage{BlockAccumulator: b}
+	for _, s := range []Storage{b, batch} {
+		d := &Decoder{MaxBlocks: st.Blocks}
+		if err = d.Decode(s, ioutil.Discard, root); err != nil {
+			t.Errorf("got %s, want %v", err, nil)
+		}
+		d.MaxBlocks = st.Blocks - 1
+		if err = d.Decode(s, ioutil.Discard, root); !errors.Is(err, ErrTooManyBlocks) {
+			t.Errorf("got %v, want %v", err, ErrTooManyBlocks)
+		}
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	progress := func(int64, int) {}
+	d := NewDecoder(WithMaxLevel(3), WithMaxBlocks(10), WithWorkers(4), WithProgress(progress), WithCache(kb))
+	if d.MaxLevel != 3 || d.MaxBlocks != 10 || d.Workers != 4 || d.OnProgress == nil || d.CacheSize != kb {
+		t.Errorf("got %+v, want every option set", d)
+	}
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(40*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if err = NewDecoder(WithMaxLevel(1)).Decode(b, ioutil.Discard, root); !errors.Is(err, ErrLevelTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrLevelTooLarge)
+	}
+}
+
+func TestDecoderWorkers(t *testing.T) {
+	content := testContent(300 * int(Size1KiB))
+	var b BlockAccumulator
+	root, st, err := EncodeStats((&b).Accumulate, bytes.NewReader(content), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var mu sync.Mutex
+	var gets int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		return b.Get(ref)
+	})
+	var buf bytes.Buffer
+	if err = NewDecoder(WithWorkers(4)).Decode(s, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	} else if gets != st.Blocks {
+		t.Errorf("got %d fetches, want %d", gets, st.Blocks)
+	}
+	// A missing block fails the decode.
+	bad := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if ref == root.Ref {
+			return b.Get(ref)
+		}
+		return nil, errors.New("missing block")
+	})
+	if err = NewDecoder(WithWorkers(4)).Decode(bad, ioutil.Discard, root); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestDecoderCache(t *testing.T) {
+	// Repeated content results in repeated content blocks.
+	content := bytes.Repeat(testContent(int(Size1KiB)), 40)
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	gets := make(map[[RefSize]byte]int)
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		gets[ref]++
+		return b.Get(ref)
+	})
+	var buf bytes.Buffer
+	if err = NewDecoder(WithCache(mb)).Decode(s, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	for ref, n := range gets {
+		if n != 1 {
+			t.Errorf("got %d fetches of %x, want %d", n, ref, 1)
+		}
+	}
+}
+
+func TestDecoderCacheStorageInterfaces(t *testing.T) {
+	content := testContent(40 * int(Size1KiB))
+	bs := &batchStorage{}
+	root, err := Encode1KiB((&bs.BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// An in-flight fetch is still cancelled.
+	_, block, _, err := ContentBlockAt(bs.BlockAccumulator, root, 4)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cs := contextStorage{BlockAccumulator: bs.BlockAccumulator, block: block}
+	if err = NewDecoder(WithCache(mb)).DecodeContext(ctx, cs, ioutil.Discard, root); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Children are still fetched with GetMany, for DecodeAll too.
+	d := NewDecoder(WithCache(mb))
+	var buf bytes.Buffer
+	if err = d.Decode(bs, &buf, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	} else if bs.batches == 0 || bs.gets != 1 {
+		t.Errorf("got %d batches and %d gets, want batches and only the root fetched with Get", bs.batches, bs.gets)
+	}
+	bs.batches, bs.gets = 0, 0
+	if err = d.DecodeAll(bs, []Ref{root, root}, func(int) io.Writer { return ioutil.Discard }); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if bs.batches == 0 || bs.gets != 1 {
+		t.Errorf("got %d batches and %d gets, want batches and only the root fetched with Get", bs.batches, bs.gets)
+	}
+	// Without a CacheSize, DecodeAll caches only inner nodes, still
+	// fetching the children of the root with GetMany once for both roots.
+	bs.batches, bs.gets = 0, 0
+	if err = new(Decoder).Decode(bs, ioutil.Discard, root); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	one := bs.batches
+	bs.batches, bs.gets = 0, 0
+	if err = new(Decoder).DecodeAll(bs, []Ref{root, root}, func(int) io.Writer { return ioutil.Discard }); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if bs.batches != 2*one-1 || bs.gets != 1 {
+		t.Errorf("got %d batches and %d gets, want %d batches and %d get", bs.batches, bs.gets, 2*one-1, 1)
+	}
+}
+
+var _ Metrics = new(countingMetrics)
+
+// countingMetrics counts the calls to each of its methods.
+type countingMetrics struct {
+	mu                                  sync.Mutex
+	gets, getErrs, hits, misses, checks int
+}
+
+func (c *countingMetrics) Get(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	if err != nil {
+		c.getErrs++
+	}
+}
+
+func (c *countingMetrics) CacheHit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hits++
+}
+
+func (c *countingMetrics) CacheMiss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses++
+}
+
+func (c *countingMetrics) Verified(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks++
+}
+
+func TestDecoderMetrics(t *testing.T) {
+	// Repeated content results in repeated content blocks.
+	content := bytes.Repeat(testContent(int(Size1KiB)), 40)
+	var b BlockAccumulator
+	root, st, err := EncodeStats((&b).Accumulate, bytes.NewReader(content), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, test := range []struct {
+		Name    string
+		Decoder Decoder
+	}{
+		{"Get", Decoder{}},
+		{"Workers", Decoder{Workers: 4}},
+		{"Cache", Decoder{CacheSize: mb}},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			m := new(countingMetrics)
+			d := test.Decoder
+			d.Metrics = m
+			if err := d.Decode(b, ioutil.Discard, root); err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if m.gets != st.Blocks || m.checks != st.Blocks || m.getErrs != 0 {
+				t.Errorf("got %d fetches, %d failed, and %d verified, want %d, %d, and %d", m.gets, m.getErrs, m.checks, st.Blocks, 0, st.Blocks)
+			}
+			if d.CacheSize == 0 && m.hits+m.misses != 0 {
+				t.Errorf("got %d cache hits and %d misses without a cache, want none", m.hits, m.misses)
+			} else if d.CacheSize > 0 && (m.hits+m.misses != m.gets || m.hits == 0) {
+				t.Errorf("got %d cache hits and %d misses for %d fetches", m.hits, m.misses, m.gets)
+			}
+		})
+	}
+}
+
+func TestDecoderEmitPartial(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	var b BlockAccumulator
+	var contentRefs [][RefSize]byte
+	root, err := NewEncoderLevel(func(eb []byte, ref [RefSize]byte, key [KeySize]byte, level int) error {
+		if level == 0 {
+			contentRefs = append(contentRefs, ref)
+		}
+		return b.Accumulate(eb, ref, key)
+	}, nil, Size1KiB).Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// Fail to fetch the tenth content block.
+	missing := contentRefs[9]
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if ref == missing {
+			return nil, errors.New("missing block")
+		}
+		return b.Get(ref)
+	})
+	for _, test := range []struct {
+		Name        string
+		EmitPartial bool
+		Workers     int
+		Want        int
+	}{
+		{"Withheld", false, 0, 8 * int(Size1KiB)},
+		{"EmitPartial", true, 0, 9 * int(Size1KiB)},
+		{"Workers", true, 4, 9 * int(Size1KiB)},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			d := &Decoder{EmitPartial: test.EmitPartial, Workers: test.Workers}
+			var buf bytes.Buffer
+			if err := d.Decode(s, &buf, root); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+			if !bytes.Equal(buf.Bytes(), content[:test.Want]) {
+				t.Errorf("got %d bytes, want the first %d bytes of content", buf.Len(), test.Want)
+			}
+		})
+	}
+	// A complete tree decodes the same.
+	var buf bytes.Buffer
+	if err = (&Decoder{EmitPartial: true}).Decode(b, &buf, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+}
+
+func TestDecoderOnBlockError(t *testing.T) {
+	content := testContent(40 * int(Size1KiB))
+	// The primary Storage has corrupt and missing blocks, while the backup
+	// has all of them. Since a failed GetMany is not for any one block, the
+	// BatchStorage only has corrupt blocks.
+	var backup, primary, corrupt BlockAccumulator
+	root, err := Encode1KiB(func(eb []byte, ref [RefSize]byte, key [KeySize]byte) error {
+		bad := append([]byte{eb[0] ^ 0xFF}, eb[1:]...)
+		switch ref[0] % 4 {
+		case 0:
+			primary.Accumulate(bad, ref, key)
+			corrupt.Accumulate(bad, ref, key)
+		case 1:
+			corrupt.Accumulate(bad, ref, key)
+		default:
+			primary.Accumulate(eb, ref, key)
+			corrupt.Accumulate(eb, ref, key)
+		}
+		return backup.Accumulate(eb, ref, key)
+	}, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, test := range []struct {
+		Name    string
+		Storage Storage
+		Workers int
+	}{
+		{"Get", primary, 0},
+		{"GetMany", &batchStorage{BlockAccumulator: corrupt}, 0},
+		{"Workers", primary, 4},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			var replaced int
+			d := &Decoder{Workers: test.Workers}
+			d.OnBlockError = func(ref [RefSize]byte, err error) ([]byte, error) {
+				mu.Lock()
+				replaced++
+				mu.Unlock()
+				return backup.Get(ref)
+			}
+			var buf bytes.Buffer
+			if err := d.Decode(test.Storage, &buf, root); err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("decoded bytes do not match content")
+			}
+			if replaced == 0 {
+				t.Errorf("got %d replaced blocks, want more", replaced)
+			}
+			// A replacement is verified too.
+			d.OnBlockError = func(ref [RefSize]byte, err error) ([]byte, error) {
+				return make([]byte, Size1KiB), nil
+			}
+			if err := d.Decode(test.Storage, ioutil.Discard, root); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+			// An error aborts decoding.
+			abort := errors.New("abort")
+			d.OnBlockError = func(ref [RefSize]byte, err error) ([]byte, error) {
+				return nil, abort
+			}
+			if err := d.Decode(test.Storage, ioutil.Discard, root); !errors.Is(err, abort) {
+				t.Errorf("got %v, want %v", err, abort)
+			}
+		})
+	}
+}
+
+func TestValidBlockSize(t *testing.T) {
+	for _, test := range []struct {
+		Size BlockSize
+		Want error
+	}{
+		{Size1KiB, nil},
+		{Size32KiB, nil},
+		{2 * (RefSize + KeySize), nil},
+		{5 * kb, nil},
+		{0, ErrBlockSizeTooSmall},
+		{RefSize + KeySize, ErrBlockSizeTooSmall},
+		{-Size1KiB, ErrBlockSizeTooSmall},
+		{1000, ErrBlockSizeMultiple},
+	} {
+		if err := ValidBlockSize(test.Size); err != test.Want {
+			t.Errorf("%d: got %v, want %v", test.Size, err, test.Want)
+		}
+	}
+	// Every function encoding content checks the block size first.
+	discard := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	r := func() io.Reader { return bytes.NewReader(testContent(100)) }
+	for _, size := range []BlockSize{RefSize + KeySize, 1000} {
+		want := ValidBlockSize(size)
+		_, err1 := Encode(discard, r(), nil, size)
+		_, err2 := EncodeContext(context.Background(), discard, r(), nil, size)
+		_, err3 := NewEncoder(discard, nil, size).Encode(r())
+		_, _, err4 := EncodeStats(discard, r(), nil, size)
+		_, err5 := NewBlockEncoder(discard, nil, size)
+		_, err6 := NewEncodingTee(discard, nil, size)
+		_, err7 := EncodeCDC(discard, r(), nil, size)
+		for i, err := range []error{err1, err2, err3, err4, err5, err6, err7} {
+			if err != want {
+				t.Errorf("%d: entry point %d: got %v, want %v", size, i+1, err, want)
+			}
+		}
+	}
+}
+
+func TestEncodeDataWithEOF(t *testing.T) {
+	discard := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	for _, n := range []int{
+		0,
+		100,
+		int(Size1KiB),
+		3 * int(Size1KiB),
+		3*int(Size1KiB) + 5,
+		17 * int(Size1KiB),
+	} {
+		content := testContent(n)
+		want, err := Encode1KiB(discard, bytes.NewReader(content), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		for _, test := range []struct {
+			Name   string
+			Reader func() io.Reader
+		}{
+			// Returns the final bytes along with io.EOF.
+			{"DataErr", func() io.Reader { return iotest.DataErrReader(bytes.NewReader(content)) }},
+			// Returns the final byte along with io.EOF, after reading the
+			// others one at a time.
+			{"OneByteDataErr", func() io.Reader {
+				return iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(content)))
+			}},
+			// Fills exactly one block in each read, the last along with
+			// io.EOF.
+			{"BlockDataErr", func() io.Reader {
+				return iotest.DataErrReader(&chunkReader{b: content, n: int(Size1KiB)})
+			}},
+		} {
+			t.Run(fmt.Sprintf("%s/%d", test.Name, n), func(t *testing.T) {
+				for _, workers := range []int{0, 4} {
+					e := NewEncoder(discard, nil, Size1KiB)
+					e.Workers = workers
+					got, err := e.Encode(test.Reader())
+					if err != nil {
+						t.Errorf("got %s, want %v", err, nil)
+					} else if !got.Equal(want) {
+						t.Errorf("%d workers: got %v, want %v", workers, got, want)
+					}
+				}
+				e := NewEncoder(discard, nil, Size1KiB)
+				if read, err := e.ReadFrom(test.Reader()); err != nil {
+					t.Errorf("got %s, want %v", err, nil)
+				} else if read != int64(n) {
+					t.Errorf("got %d bytes read, want %d", read, n)
+				}
+			})
+		}
+	}
+}
+
+// chunkReader reads at most n bytes at a time.
+type chunkReader struct {
+	b []byte
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.b) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	n := copy(p, c.b)
+	c.b = c.b[n:]
+	return n, nil
+}
+
+func TestEncodeExactMultiple(t *testing.T) {
+	// Content lengths that are exact multiples of the block size, which are
+	// followed by a block consisting of only padding.
+	for _, file := range []string{
+		"test-vectors_eris-test-vector-03.json",
+		"test-vectors_eris-test-vector-05.json",
+		"test-vectors_eris-test-vector-06.json",
+		"test-vectors_eris-test-vector-08.json",
+	} {
+		b, err := ioutil.ReadFile("./testdata/" + file)
+		if err != nil {
+			t.Errorf("error reading %s: %v", file, err)
+			continue
+		}
+		var test TestVector
+		err = json.Unmarshal(b, &test)
+		if err != nil {
+			t.Errorf("error unmarshalling %s: %v", file, err)
+			continue
+		}
+		bcon, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(test.Content)
+		if err != nil {
+			t.Errorf("error decoding content %s: %v", file, err)
+			continue
+		}
+		bconv, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(test.ConvergenceSecret)
+		if err != nil {
+			t.Errorf("error decoding convergence secret %s: %v", file, err)
+			continue
+		}
+		t.Run(test.Name, func(t *testing.T) {
+			if len(bcon)%int(test.BlockSize) != 0 {
+				t.Fatalf("content of %d bytes is not a multiple of %d", len(bcon), test.BlockSize)
+			}
+			var acc BlockAccumulator
+			ref, st, err := EncodeStats((&acc).Accumulate, bytes.NewReader(bcon), bconv, test.BlockSize)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if want := len(bcon)/int(test.BlockSize) + 1; st.ContentBlocks != want {
+				t.Errorf("got %d content blocks, want %d", st.ContentBlocks, want)
+			}
+			if st.Blocks != st.ContentBlocks+st.InnerBlocks {
+				t.Errorf("got %d blocks, want %d", st.Blocks, st.ContentBlocks+st.InnerBlocks)
+			}
+			if err = acc.Diff(test.Blocks); err != nil {
+				t.Errorf("%v", err)
+			}
+			if urn, _ := ref.URN(); urn != test.URN {
+				t.Errorf("got %s, want %s", urn, test.URN)
+			}
+			var buf bytes.Buffer
+			if err = Decode(acc, &buf, ref); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if !bytes.Equal(buf.Bytes(), bcon) {
+				t.Errorf("decoded bytes do not match content")
+			}
+		})
+	}
+}
+
+func TestBlockEncoder(t *testing.T) {
+	for _, blocks := range []int{0, 1, 16, 40} {
+		content := testContent(blocks * int(Size1KiB))
+		want, err := Encode1KiB(func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }, bytes.NewReader(content), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		var b BlockAccumulator
+		be, err := NewBlockEncoder((&b).Accumulate, nil, Size1KiB)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		for off := 0; off < len(content); off += int(Size1KiB) {
+			if err = be.WriteBlock(content[off : off+int(Size1KiB)]); err != nil {
+				t.Fatalf("%d: got %s, want %v", blocks, err, nil)
+			}
+		}
+		root, err := be.Finish()
+		if err != nil {
+			t.Fatalf("%d: got %s, want %v", blocks, err, nil)
+		} else if !root.Equal(want) {
+			t.Errorf("%d: got %v, want %v", blocks, root, want)
+		}
+		if !bytes.Equal(content, testContent(blocks*int(Size1KiB))) {
+			t.Errorf("%d: written blocks were modified", blocks)
+		}
+		var buf bytes.Buffer
+		if err = Decode(b, &buf, root); err != nil {
+			t.Errorf("%d: got %s, want %v", blocks, err, nil)
+		} else if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("%d: decoded bytes do not match content", blocks)
+		}
+		if err = be.WriteBlock(make([]byte, Size1KiB)); err == nil {
+			t.Errorf("%d: got %v, want an error", blocks, err)
+		}
+	}
+}
+
+func TestBlockEncoderBlockLength(t *testing.T) {
+	content := testContent(16 * int(Size1KiB))
+	want, err := Encode1KiB(func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	be, err := NewBlockEncoder(func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }, nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for off := 0; off < len(content); off += int(Size1KiB) {
+		// Short and long blocks are rejected without affecting the tree.
+		if err = be.WriteBlock(content[off : off+int(Size1KiB)-1]); !errors.Is(err, ErrBlockLength) {
+			t.Errorf("got %v, want %v", err, ErrBlockLength)
+		}
+		if err = be.WriteBlock(make([]byte, Size1KiB+1)); !errors.Is(err, ErrBlockLength) {
+			t.Errorf("got %v, want %v", err, ErrBlockLength)
+		}
+		if err = be.WriteBlock(content[off : off+int(Size1KiB)]); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	root, err := be.Finish()
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !root.Equal(want) {
+		t.Errorf("got %v, want %v", root, want)
+	}
+}
+
+func TestBlockRefReadKey(t *testing.T) {
+	content := []byte("content of a single block")
+	secret := make([]byte, 32)
+	var eblock []byte
+	root, err := EncodeSingleBlock(func(eb []byte, ref [RefSize]byte, readkey [KeySize]byte) error {
+		eblock = append([]byte(nil), eb...)
+		return nil
+	}, content, secret, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if got := BlockRef(eblock); got != root.Ref {
+		t.Errorf("got %x, want %x", got, root.Ref)
+	}
+	ublock := padContentBlock(append([]byte(nil), content...), Size1KiB)
+	if got, err := ReadKey(ublock, secret); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if got != root.Key {
+		t.Errorf("got %x, want %x", got, root.Key)
+	}
+}
+
+func TestConvergenceSecret(t *testing.T) {
+	content := testContent(10 * int(Size1KiB))
+	discard := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	nilRoot, err := Encode1KiB(discard, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// An empty secret is the same as none.
+	emptyRoot, err := Encode1KiB(discard, bytes.NewReader(content), []byte{})
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if !emptyRoot.Equal(nilRoot) {
+		t.Errorf("got %v, want %v", emptyRoot, nilRoot)
+	}
+	if _, err = Encode1KiB(discard, bytes.NewReader(content), make([]byte, MaxSecretSize)); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if _, err = Encode1KiB(discard, bytes.NewReader(content), make([]byte, MaxSecretSize+1)); !errors.Is(err, ErrSecretTooLong) {
+		t.Errorf("got %v, want %v", err, ErrSecretTooLong)
+	}
+	if _, err = ReadKey(make([]byte, Size1KiB), make([]byte, MaxSecretSize+1)); !errors.Is(err, ErrSecretTooLong) {
+		t.Errorf("got %v, want %v", err, ErrSecretTooLong)
+	}
+}
+
+func TestSecretKDF(t *testing.T) {
+	content := testContent(40 * int(Size1KiB))
+	discard := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	passphrase := bytes.Repeat([]byte("correct horse battery staple "), 4)
+	derived := DeriveSecret(passphrase)
+	want, err := Encode1KiB(discard, bytes.NewReader(content), derived[:])
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, workers := range []int{0, 4} {
+		e := NewEncoder(discard, passphrase, Size1KiB)
+		e.SecretKDF = true
+		e.Workers = workers
+		got, err := e.Encode(bytes.NewReader(content))
+		if err != nil {
+			t.Errorf("got %s, want %v", err, nil)
+		} else if !got.Equal(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	// Without SecretKDF the passphrase is too long to be a raw secret.
+	if _, err = Encode1KiB(discard, bytes.NewReader(content), passphrase); !errors.Is(err, ErrSecretTooLong) {
+		t.Errorf("got %v, want %v", err, ErrSecretTooLong)
+	}
+	// A short secret is still derived rather than used as is.
+	e := NewEncoder(discard, []byte("secret"), Size1KiB)
+	e.SecretKDF = true
+	kdf, err := e.Encode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	raw, err := Encode1KiB(discard, bytes.NewReader(content), []byte("secret"))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if kdf.Equal(raw) {
+		t.Errorf("derived and raw secrets encoded to the same root %v", raw)
+	}
+}
+
+func TestAccumulatorLevelTooLarge(t *testing.T) {
+	discard := func([]byte, [RefSize]byte, [KeySize]byte, int) error { return nil }
+	// An accumulator of the highest representable level, as if at the top of
+	// an enormous tree.
+	acc, err := newAccumulator(primitives{}, discard, Size1KiB, nil, math.MaxUint8, nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var ref [RefSize]byte
+	var key [KeySize]byte
+	ref[0] = 1
+	for i := 0; i < int(Size1KiB)/(RefSize+KeySize); i++ {
+		if err = acc.RecurAccumulate(ref, key); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	// Another pair requires a parent node above the highest level.
+	if err = acc.RecurAccumulate(ref, key); !errors.Is(err, ErrLevelTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrLevelTooLarge)
+	}
+}
+
+// innerNode encrypts an inner node of the children's read capabilities,
+// accumulating it and returning its read capability one level above them.
+func innerNode(t *testing.T, b *BlockAccumulator, children ...Ref) Ref {
+	ub := make(ubytes, children[0].BlockSize)
+	for i, c := range children {
+		copy(ub[i*(RefSize+KeySize):], c.Ref[:])
+		copy(ub[i*(RefSize+KeySize)+RefSize:], c.Key[:])
+	}
+	eb, ref, key, err := marshalBlock(ub, nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	b.Accumulate(eb, ref, key)
+	return Ref{BlockSize: children[0].BlockSize, Level: children[0].Level + 1, Ref: ref, Key: key}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	var b BlockAccumulator
+	canonical, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(40*int(Size1KiB)+100)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	small, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(3*int(Size1KiB)-10)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	single, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(100)), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	tests := []struct {
+		Name string
+		Root Ref
+		Want error
+	}{
+		{"canonical", canonical, nil},
+		{"canonical single block", single, nil},
+		// A root with one child is taller than needed.
+		{"tall root", innerNode(t, &b, small), ErrNonCanonicalTree},
+		{"tall single block", innerNode(t, &b, single), ErrNonCanonicalTree},
+		// An inner node other than the last is not full.
+		{"short inner node", innerNode(t, &b, small, small), ErrNonCanonicalTree},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := Decode(b, ioutil.Discard, test.Root); err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			}
+			d := &Decoder{Strict: true}
+			if err := d.Decode(b, ioutil.Discard, test.Root); !errors.Is(err, test.Want) {
+				t.Errorf("got %v, want %v", err, test.Want)
+			}
+			d.Workers = 4
+			if err := d.Decode(b, ioutil.Discard, test.Root); !errors.Is(err, test.Want) {
+				t.Errorf("got %v, want %v", err, test.Want)
+			}
+		})
+	}
+	if err = checkCanonicalPadding(ISO7816{}, padContentBlock(ubytes("content"), Size1KiB)); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+	if err = checkCanonicalPadding(ISO7816{}, make(ubytes, Size1KiB)); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestMalformedInnerNode(t *testing.T) {
+	td := &treeDecoder{
+		d:    new(Decoder),
+		ctx:  context.Background(),
+		sink: newPaddingSink(ioutil.Discard, Size1KiB),
+		size: Size1KiB,
+	}
+	// A decrypted inner node ending partway through a reference-key pair.
+	var key [KeySize]byte
+	err := td.decodeBlock(1, make([]byte, RefSize+KeySize+RefSize), key, true)
+	if !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if err = checkInnerNode(make(ubytes, Size1KiB)); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	}
+}
+
+func TestInnerNodePairAfterPadding(t *testing.T) {
+	m := NewMemStorage()
+	node := make(ubytes, Size1KiB)
+	for _, i := range []int{0, 2} {
+		content := padContentBlock(ubytes("content"), Size1KiB)
+		eb, ref, key, err := marshalBlock(content, nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		m.Put(eb, ref)
+		off := i * (RefSize + KeySize)
+		copy(node[off:], ref[:])
+		copy(node[off+RefSize:], key[:])
+	}
+	// The pair at index 1 is all zero, yet is followed by another child.
+	eb, ref, key, err := marshalBlock(node, nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	m.Put(eb, ref)
+	root := Ref{BlockSize: Size1KiB, Level: 1, Ref: ref, Key: key}
+	if err = Decode(m, ioutil.Discard, root); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if err = Verify(m, root); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if err = DecodeParallel(m, ioutil.Discard, root, 4); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if _, err = ContentSize(m, root); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if _, _, _, err = ContentBlockAt(m, root, 0); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+	if _, err = ListRefs(m, root); !errors.Is(err, ErrMalformedInnerNode) {
+		t.Errorf("got %v, want %v", err, ErrMalformedInnerNode)
+	}
+}
+
+func TestDecoderWriteTo(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	d := new(Decoder)
+	if _, err := d.WriteTo(ioutil.Discard); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+	d.Reset(b, root)
+	var buf bytes.Buffer
+	var wt io.WriterTo = d
+	n, err := wt.WriteTo(&buf)
+	if err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if n != int64(len(content)) {
+		t.Errorf("got %d bytes, want %d", n, len(content))
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("decoded bytes do not match content")
+	}
+	// A failed write reports the bytes written before it.
+	w := &limitedWriter{n: 5 * int(Size1KiB)}
+	if n, err = d.WriteTo(w); err == nil {
+		t.Errorf("got %v, want an error", err)
+	} else if n != int64(w.n) {
+		t.Errorf("got %d bytes, want %d", n, w.n)
+	}
+}
+
+// limitedWriter accepts at most n bytes, then fails every write.
+type limitedWriter struct {
+	n       int
+	written int
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.written+len(b) > l.n {
+		return 0, errors.New("writer is full")
+	}
+	l.written += len(b)
+	return len(b), nil
+}
+
+func TestEncoderReadFrom(t *testing.T) {
+	content := testContent(40*int(Size1KiB) + 100)
+	want, err := Encode1KiB(new(BlockAccumulator).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var b BlockAccumulator
+	e := NewEncoder((&b).Accumulate, nil, Size1KiB)
+	if _, err = e.Root(); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+	var rf io.ReaderFrom = e
+	n, err := rf.ReadFrom(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	} else if n != int64(len(content)) {
+		t.Errorf("got %d bytes, want %d", n, len(content))
+	}
+	if root, err := e.Root(); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !root.Equal(want) {
+		t.Errorf("got %v, want %v", root, want)
+	}
+	// A failed read leaves no root.
+	r := io.MultiReader(bytes.NewReader(content[:100]), ReaderFunc(func([]byte) (int, error) {
+		return 0, errors.New("read failed")
+	}))
+	if n, err = e.ReadFrom(r); err == nil {
+		t.Errorf("got %v, want an error", err)
+	} else if n != 100 {
+		t.Errorf("got %d bytes, want %d", n, 100)
+	}
+	if _, err = e.Root(); err == nil {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	for _, n := range []int{0, 1, 100, int(Size1KiB) - 1} {
+		block := make([]byte, Size1KiB)
+		copy(block, testContent(n))
+		Pad(block[n:])
+		if block[n] != 0x80 {
+			t.Errorf("%d: got marker %#x, want %#x", n, block[n], 0x80)
+		}
+		got, err := Unpad(block)
+		if err != nil {
+			t.Errorf("%d: got %s, want %v", n, err, nil)
+		} else if !bytes.Equal(got, testContent(n)) {
+			t.Errorf("%d: unpadded bytes do not match content", n)
+		}
+	}
+	// Padding an empty buffer is a no-op.
+	Pad(nil)
+	var perr BadPaddingError
+	if _, err := Unpad(make([]byte, 10)); !errors.As(err, &perr) || !perr.MissingMarker {
+		t.Errorf("got %v, want a missing marker", err)
+	}
+	if _, err := Unpad([]byte{1, 0x80, 0, 2}); !errors.As(err, &perr) || perr.Offset != 3 {
+		t.Errorf("got %v, want offset %d", err, 3)
+	}
+}
+
+// TestEncoderReuseVectors encodes every test vector twice with one reused
+// Encoder, so that the accumulators of the later trees begin with the stale
+// buffers of the earlier ones.
+func TestEncoderReuseVectors(t *testing.T) {
+	var tests []TestVector
+	for _, file := range allFiles() {
+		b, err := ioutil.ReadFile("./testdata/" + file)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", file, err)
+		}
+		var test TestVector
+		if err = json.Unmarshal(b, &test); err != nil {
+			t.Fatalf("error unmarshalling %s: %v", file, err)
+		}
+		tests = append(tests, test)
+	}
+	e := new(Encoder)
+	for pass := 0; pass < 2; pass++ {
+		for _, test := range tests {
+			bcon, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(test.Content)
+			if err != nil {
+				t.Fatalf("error decoding content %s: %v", test.Name, err)
+			}
+			bconv, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(test.ConvergenceSecret)
+			if err != nil {
+				t.Fatalf("error decoding convergence secret %s: %v", test.Name, err)
+			}
+			var acc BlockAccumulator
+			e.Reset((&acc).Accumulate, bconv, test.BlockSize)
+			ref, err := e.Encode(bytes.NewReader(bcon))
+			if err != nil {
+				t.Fatalf("%s: got %s, want %v", test.Name, err, nil)
+			}
+			if err = acc.Diff(test.Blocks); err != nil {
+				t.Errorf("%s: %v", test.Name, err)
+			}
+			if urn, _ := ref.URN(); urn != test.URN {
+				t.Errorf("%s: got %s, want %s", test.Name, urn, test.URN)
+			}
+		}
+	}
+}
+
+// countingBatchStorage is a BatchStorage counting the fetches of each block,
+// whether by Get or GetMany.
+type countingBatchStorage struct {
+	BlockAccumulator
+	gets map[[RefSize]byte]int
+}
+
+func (c *countingBatchStorage) Get(ref [RefSize]byte) ([]byte, error) {
+	c.gets[ref]++
+	return c.BlockAccumulator.Get(ref)
+}
+
+func (c *countingBatchStorage) GetMany(refs [][RefSize]byte) ([][]byte, error) {
+	blocks := make([][]byte, len(refs))
+	for i, ref := range refs {
+		eb, err := c.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = eb
+	}
+	return blocks, nil
+}
+
+func TestDecodeAll(t *testing.T) {
+	// Both contents share their first 32 content blocks, and so the inner
+	// nodes above them.
+	shared := testContent(64 * int(Size1KiB))
+	contents := [][]byte{
+		shared[:48*int(Size1KiB)],
+		append(append([]byte(nil), shared[:32*int(Size1KiB)]...), testContent(100)...),
+	}
+	var b BlockAccumulator
+	roots := make([]Ref, len(contents))
+	for i, c := range contents {
+		var err error
+		if roots[i], err = Encode1KiB((&b).Accumulate, bytes.NewReader(c), nil); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	for _, batch := range []bool{false, true} {
+		gets := make(map[[RefSize]byte]int)
+		var s Storage = StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+			gets[ref]++
+			return b.Get(ref)
+		})
+		if batch {
+			s = &countingBatchStorage{BlockAccumulator: b, gets: gets}
+		}
+		bufs := make([]bytes.Buffer, len(contents))
+		err := DecodeAll(s, roots, func(i int) io.Writer { return &bufs[i] })
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		for i := range contents {
+			if !bytes.Equal(bufs[i].Bytes(), contents[i]) {
+				t.Errorf("%d: decoded bytes do not match content", i)
+			}
+		}
+		// The two level 1 nodes above the shared content blocks are
+		// fetched once.
+		err = WalkRefs(b, roots[1], func(ref [RefSize]byte, level int) error {
+			if level > 0 && gets[ref] != 1 {
+				t.Errorf("batch %t: got %d fetches of a level %d node, want %d", batch, gets[ref], level, 1)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("got %s, want %v", err, nil)
+		}
+	}
+	// Errors are reported with the index of the root.
+	bad := append([]Ref{}, roots...)
+	bad[1].Ref[0] ^= 0xFF
+	err := DecodeAll(b, bad, func(i int) io.Writer { return ioutil.Discard })
+	if err == nil || !strings.Contains(err.Error(), "root 1") {
+		t.Errorf("got %v, want an error decoding root 1", err)
+	}
+}
+
+func TestEmptyStorageResult(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(10*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, empty := range [][]byte{nil, {}} {
+		s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+			return empty, nil
+		})
+		if err = Decode(s, ioutil.Discard, root); !errors.Is(err, ErrEmptyStorageResult) {
+			t.Errorf("got %v, want %v", err, ErrEmptyStorageResult)
+		}
+	}
+	// A short block is a different error.
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		return []byte{1}, nil
+	})
+	if err = Decode(s, ioutil.Discard, root); err == nil || errors.Is(err, ErrEmptyStorageResult) {
+		t.Errorf("got %v, want an error other than %v", err, ErrEmptyStorageResult)
+	}
+}
+
+func TestStorageBlockLength(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(10*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	for _, test := range []struct {
+		Name   string
+		Change func(eb []byte) []byte
+		Want   error
+	}{
+		{"truncated", func(eb []byte) []byte { return eb[:len(eb)-1] }, ErrBlockTooShort},
+		{"extra bytes", func(eb []byte) []byte { return append(eb, 0) }, ErrBlockTooLong},
+		{"next block", func(eb []byte) []byte { return append(eb, eb...) }, ErrBlockTooLong},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+				eb, err := b.Get(ref)
+				if err != nil {
+					return nil, err
+				}
+				return test.Change(eb), nil
+			})
+			if err := Decode(s, ioutil.Discard, root); !errors.Is(err, test.Want) {
+				t.Errorf("got %v, want %v", err, test.Want)
+			}
+			if err := Verify(s, root); !errors.Is(err, test.Want) {
+				t.Errorf("got %v, want %v", err, test.Want)
+			}
+		})
+	}
+}
+
+// bufferAt is an io.WriterAt over a byte slice, growing it as needed.
+type bufferAt struct {
+	b []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(b.b) {
+		b.b = append(b.b, make([]byte, end-len(b.b))...)
+	}
+	return copy(b.b[off:], p), nil
+}
+
+func TestDecodeAt(t *testing.T) {
+	for _, length := range []int{0, 100, int(Size1KiB), 40*int(Size1KiB) + 100} {
+		b, root, content := encodeTestContent(t, length)
+		var w bufferAt
+		if err := DecodeAt(b, &w, root); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if !bytes.Equal(w.b, content) {
+			t.Errorf("%d: decoded bytes do not match content", length)
+		}
+		// A file preallocated with other bytes is overwritten and truncated.
+		f, err := os.Create(filepath.Join(t.TempDir(), "content"))
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if _, err = f.Write(bytes.Repeat([]byte{0xFF}, length+2*int(Size1KiB))); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if err = DecodeAt(b, f, root); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		}
+		f.Close()
+		if got, err := ioutil.ReadFile(f.Name()); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if !bytes.Equal(got, content) {
+			t.Errorf("%d: decoded file does not match content", length)
+		}
+	}
+}
+
+func TestDecodeToFile(t *testing.T) {
+	for _, length := range []int{0, 100, int(Size1KiB), 40*int(Size1KiB) + 100} {
+		b, root, content := encodeTestContent(t, length)
+		// An existing longer file is replaced.
+		path := filepath.Join(t.TempDir(), "content")
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0xFF}, length+2*int(Size1KiB)), 0644); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if err := DecodeToFile(b, path, root); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if got, err := ioutil.ReadFile(path); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if !bytes.Equal(got, content) {
+			t.Errorf("%d: decoded file does not match content", length)
+		}
+		// A failed decode leaves the existing file untouched, and no
+		// temporary file behind.
+		if err := DecodeToFile(BlockAccumulator{}, path, root); err == nil {
+			t.Errorf("%d: got %v, want an error", length, err)
+		} else if got, err := ioutil.ReadFile(path); err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if !bytes.Equal(got, content) {
+			t.Errorf("%d: existing file was modified", length)
+		}
+		if names, err := filepath.Glob(filepath.Join(filepath.Dir(path), ".tmp-*")); err != nil || len(names) != 0 {
+			t.Errorf("%d: got temporary files %v, want none", length, names)
+		}
+		// Nor is a file created.
+		missing := filepath.Join(filepath.Dir(path), "missing")
+		if err := DecodeToFile(BlockAccumulator{}, missing, root); err == nil {
+			t.Errorf("%d: got %v, want an error", length, err)
+		} else if _, err = os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("%d: got %v, want the file not to exist", length, err)
+		}
 	}
-	b.Logf("ref=%s", urn)
-	b.Logf("number of blocks: %d", nBlocks)
 }
@@ -0,0 +1,497 @@
+package eris
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ContentBlockAt fetches the content block at the zero-based index within the
+// tree descendent of the root reference, returning its decrypted plaintext
+// along with the block's reference and read key.
+//
+// Only the inner nodes on the path from the root to the content block are
+// fetched, as the layout of the tree is deterministic given the root level
+// and block size.
+//
+// The final content block is returned with its padding stripped, so a returned
+// plaintext shorter than the block size indicates the index is the last one in
+// the tree. All other content blocks are returned whole.
+func ContentBlockAt(s Storage, root Ref, index int64) (plaintext []byte, ref [RefSize]byte, key [KeySize]byte, err error) {
+	if err = checkBlockSize(root.BlockSize); err != nil {
+		return
+	}
+	if root.Level < 0 {
+		err = errors.New("root level is negative")
+		return
+	} else if index < 0 {
+		err = errors.New("content block index is negative")
+		return
+	}
+	path := contentBlockPath(root.BlockSize, index)
+	if len(path) > root.Level {
+		err = errIndexOutOfRange
+		return
+	}
+	ref, key = root.Ref, root.Key
+	// Walk down the inner nodes, tracking whether every step selected the
+	// final child, which means the path ends at the final content block.
+	last := true
+	for level := root.Level; level > 0; level-- {
+		var eb ebytes
+		eb, err = checkedGet(s, ref, root.BlockSize)
+		if err != nil {
+			return
+		}
+		var ub ubytes
+		ub, err = decrypt(eb, key)
+		if err != nil {
+			return
+		} else if err = checkInnerNode(ub); err != nil {
+			return
+		}
+		i := 0
+		if level-1 < len(path) {
+			i = path[level-1]
+		}
+		ref, key = refKeyPairAt(ub, i)
+		if refKeyPairAllZero(ref, key) {
+			err = errIndexOutOfRange
+			return
+		}
+		if last && (i+1)*(RefSize+KeySize) < len(ub) {
+			nr, nk := refKeyPairAt(ub, i+1)
+			last = refKeyPairAllZero(nr, nk)
+		}
+	}
+	// Fetch the content block itself.
+	var eb ebytes
+	eb, err = checkedGet(s, ref, root.BlockSize)
+	if err != nil {
+		return
+	}
+	var ub ubytes
+	ub, err = decrypt(eb, key)
+	if err != nil {
+		return
+	}
+	if last {
+		ub, err = unpad(ub)
+		if err != nil {
+			return
+		}
+	}
+	plaintext = ub
+	return
+}
+
+// errIndexOutOfRange is returned when a content block index is beyond the
+// final content block.
+var errIndexOutOfRange = errors.New("content block index out of range")
+
+// ContentSize computes the exact length of the decoded content without
+// decoding it, such as to determine a Content-Length before streaming.
+//
+// Only the inner nodes along the rightmost path of the tree and the final
+// content block are fetched, as every other content block is full.
+func ContentSize(s Storage, root Ref) (int64, error) {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return 0, err
+	}
+	if root.Level < 0 {
+		return 0, errors.New("root level is negative")
+	}
+	ref, key := root.Ref, root.Key
+	// Count the content blocks preceding the final one.
+	var n int64
+	for level := root.Level; level > 0; level-- {
+		eb, err := checkedGet(s, ref, root.BlockSize)
+		if err != nil {
+			return 0, err
+		}
+		ub, err := decrypt(eb, key)
+		if err != nil {
+			return 0, err
+		} else if err = checkInnerNode(ub); err != nil {
+			return 0, err
+		}
+		c := childCount(ub)
+		if c == 0 {
+			return 0, errors.New("inner node has no children")
+		}
+		if c > 1 {
+			span, err := blocksAtLevel(root.BlockSize, level-1)
+			if err != nil {
+				return 0, err
+			}
+			if int64(c-1) > (math.MaxInt64-n)/span {
+				return 0, ErrContentTooLarge
+			}
+			n += int64(c-1) * span
+		}
+		ref, key = refKeyPairAt(ub, c-1)
+	}
+	eb, err := checkedGet(s, ref, root.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return 0, err
+	}
+	ub, err = unpad(ub)
+	if err != nil {
+		return 0, err
+	}
+	if n > (math.MaxInt64-int64(len(ub)))/int64(root.BlockSize) {
+		return 0, ErrContentTooLarge
+	}
+	return n*int64(root.BlockSize) + int64(len(ub)), nil
+}
+
+// Description summarizes the structure and size of an encoded object.
+type Description struct {
+	BlockSize BlockSize
+	// Level of the root block, which is the height of the tree.
+	Level int
+	// Number of blocks in the tree, which is the sum of InnerBlocks and
+	// ContentBlocks. Blocks are counted by their position in the tree, so a
+	// block appearing multiple times is counted multiple times.
+	Blocks        int64
+	InnerBlocks   int64
+	ContentBlocks int64
+	// Exact length of the decoded content, without padding.
+	ContentLength int64
+	URN           string
+}
+
+// Describe walks the tree descendent of the root reference once, collecting a
+// Description of the encoded object. Every inner node and the final content
+// block are fetched from the Storage.
+func Describe(s Storage, root Ref) (d Description, err error) {
+	d.BlockSize = root.BlockSize
+	d.Level = root.Level
+	d.URN, err = root.URN()
+	if err != nil {
+		return
+	}
+	var lastRef [RefSize]byte
+	var lastKey [KeySize]byte
+	err = walkRefs(s, root, func(ref [RefSize]byte, key [KeySize]byte, level int) error {
+		d.Blocks++
+		if level == 0 {
+			d.ContentBlocks++
+			lastRef, lastKey = ref, key
+		} else {
+			d.InnerBlocks++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	// Only the final content block contributes a partial length.
+	var eb ebytes
+	eb, err = checkedGet(s, lastRef, root.BlockSize)
+	if err != nil {
+		return
+	}
+	var ub ubytes
+	ub, err = decrypt(eb, lastKey)
+	if err != nil {
+		return
+	}
+	ub, err = unpad(ub)
+	if err != nil {
+		return
+	}
+	d.ContentLength = (d.ContentBlocks-1)*int64(root.BlockSize) + int64(len(ub))
+	return
+}
+
+// UpdateDelta determines the references of the blocks present in the tree of
+// the "to" root that are absent from the tree of the "from" root. These are
+// exactly the blocks a client already holding "from" must fetch in order to
+// obtain "to".
+//
+// Since blocks are content addressed, subtrees shared between both trees are
+// not traversed when walking the "to" tree.
+func UpdateDelta(s Storage, from, to Ref) (needed [][RefSize]byte, err error) {
+	if from.BlockSize != to.BlockSize {
+		err = errors.New("cannot compute update delta between different block sizes")
+		return
+	}
+	have := make(map[[RefSize]byte]int)
+	err = walkRefs(s, from, func(ref [RefSize]byte, key [KeySize]byte, level int) error {
+		have[ref] = level
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	seen := make(map[[RefSize]byte]struct{})
+	err = walkRefs(s, to, func(ref [RefSize]byte, key [KeySize]byte, level int) error {
+		if l, ok := have[ref]; ok {
+			if l == level {
+				return errSkipSubtree
+			}
+			return nil
+		}
+		if _, ok := seen[ref]; !ok {
+			seen[ref] = struct{}{}
+			needed = append(needed, ref)
+		}
+		return nil
+	})
+	return
+}
+
+// WalkRefs applies a depth-first walk over the tree descendent of the root
+// reference, calling fn with the reference and level of every inner node and
+// content block. A block appearing multiple times in the tree is passed to fn
+// each time.
+//
+// Only inner nodes are fetched from the Storage, as content block references
+// are all contained within their parents. An error returned by fn aborts the
+// walk and is returned.
+func WalkRefs(s Storage, root Ref, fn func(ref [RefSize]byte, level int) error) error {
+	return walkRefs(s, root, func(ref [RefSize]byte, key [KeySize]byte, level int) error {
+		return fn(ref, level)
+	})
+}
+
+// WalkTree applies a depth-first walk over the tree descendent of the root
+// reference like WalkRefs, additionally passing fn the decrypted reference-key
+// pairs of the children of each inner node, without the trailing padding.
+// Content blocks are passed a nil children.
+//
+// Since fn is called once an inner node has been fetched, it sees the node
+// before any of its descendents. An error returned by fn aborts the walk and
+// is returned.
+func WalkTree(s Storage, root Ref, fn func(level int, ref [RefSize]byte, children [][RefSize + KeySize]byte) error) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	} else if root.Level < 0 {
+		return errors.New("root level is negative")
+	}
+	return walkTreeRecur(s, root.Level, root.Ref, root.Key, root.BlockSize, fn)
+}
+
+// walkTreeRecur is the recursive implementation of WalkTree.
+func walkTreeRecur(s Storage, level int, ref [RefSize]byte, key [KeySize]byte, size BlockSize, fn func(int, [RefSize]byte, [][RefSize + KeySize]byte) error) error {
+	if level == 0 {
+		return fn(level, ref, nil)
+	}
+	eb, err := checkedGet(s, ref, size)
+	if err != nil {
+		return err
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return err
+	} else if err = checkInnerNode(ub); err != nil {
+		return err
+	}
+	children := make([][RefSize + KeySize]byte, childCount(ub))
+	for i := range children {
+		copy(children[i][:], ub[i*(RefSize+KeySize):])
+	}
+	if err = fn(level, ref, children); err != nil {
+		return err
+	}
+	for _, c := range children {
+		var r [RefSize]byte
+		var k [KeySize]byte
+		copy(r[:], c[:RefSize])
+		copy(k[:], c[RefSize:])
+		if err = walkTreeRecur(s, level-1, r, k, size, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRefs determines the unique references of every inner node and content
+// block in the tree descendent of the root reference, in depth-first order.
+//
+// For very large trees, prefer WalkRefs to avoid buffering the entire list.
+func ListRefs(s Storage, root Ref) (refs [][RefSize]byte, err error) {
+	seen := make(map[[RefSize]byte]struct{})
+	err = WalkRefs(s, root, func(ref [RefSize]byte, level int) error {
+		if _, ok := seen[ref]; !ok {
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return
+}
+
+// errSkipSubtree is returned by a walkRefsFn to indicate that the children of
+// the current block are not to be walked.
+var errSkipSubtree = errors.New("skip subtree")
+
+// walkRefsFn is called for each block reference in a tree along with the read
+// key and level of the block.
+type walkRefsFn func(ref [RefSize]byte, key [KeySize]byte, level int) error
+
+// walkRefs applies a depth-first walk over the references of every block in
+// the tree, calling fn for each one. Only inner nodes are fetched, as content
+// block references are all contained within their parents.
+func walkRefs(s Storage, root Ref, fn walkRefsFn) error {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return err
+	}
+	return walkRefsRecur(s, root.Level, root.Ref, root.Key, root.BlockSize, fn)
+}
+
+// walkRefsRecur is the recursive implementation of walkRefs.
+func walkRefsRecur(s Storage, level int, ref [RefSize]byte, key [KeySize]byte, size BlockSize, fn walkRefsFn) error {
+	err := fn(ref, key, level)
+	if err == errSkipSubtree {
+		return nil
+	} else if err != nil {
+		return err
+	} else if level == 0 {
+		return nil
+	}
+	eb, err := checkedGet(s, ref, size)
+	if err != nil {
+		return err
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return err
+	} else if err = checkInnerNode(ub); err != nil {
+		return err
+	}
+	for i := 0; i < len(ub)/(RefSize+KeySize); i++ {
+		r, k := refKeyPairAt(ub, i)
+		if refKeyPairAllZero(r, k) {
+			return nil
+		}
+		err = walkRefsRecur(s, level-1, r, k, size, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Arity is the number of reference-key pairs held by an inner node of the
+// given block size, which is the greatest number of children it may have:
+// 16 for 1KiB blocks and 512 for 32KiB blocks.
+func Arity(size BlockSize) int {
+	return int(size) / (RefSize + KeySize)
+}
+
+// BlocksAtLevel computes the greatest number of content blocks descendent of a
+// single block at the given level of a tree, which is the Arity raised to the
+// level. A level 0 block is itself the one content block.
+//
+// The result is clamped to math.MaxInt64. Returns 0 for a negative level or a
+// block size that cannot be encoded.
+func BlocksAtLevel(size BlockSize, level int) int64 {
+	if level < 0 || ValidBlockSize(size) != nil {
+		return 0
+	}
+	n, err := blocksAtLevel(size, level)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return n
+}
+
+// contentBlockPath determines the child index to select at each inner node in
+// order to reach the content block at the given index. The first element is
+// the child index within the level 1 inner node, the second within the level
+// 2 inner node, and so on.
+//
+// Levels beyond the length of the returned path always select the first child.
+func contentBlockPath(size BlockSize, index int64) []int {
+	arity := int64(Arity(size))
+	var path []int
+	for ; index > 0; index /= arity {
+		path = append(path, int(index%arity))
+	}
+	return path
+}
+
+// LevelFor computes the level of the root reference that encoding the given
+// number of content bytes into blocks of the size results in. Since content is
+// always padded, content that is an exact multiple of the block size is
+// followed by a block of only padding, which may need another level.
+//
+// Returns -1 for a negative number of bytes or a block size that cannot be
+// encoded. A level greater than math.MaxUint8 cannot be encoded.
+func LevelFor(size BlockSize, contentBytes int64) int {
+	if contentBytes < 0 || ValidBlockSize(size) != nil {
+		return -1
+	}
+	blocks := contentBytes/int64(size) + 1
+	arity := int64(Arity(size))
+	level := 0
+	for n := int64(1); n < blocks; level++ {
+		if n > math.MaxInt64/arity {
+			return level + 1
+		}
+		n *= arity
+	}
+	return level
+}
+
+// blocksAtLevel computes the maximum number of content blocks descendent of a
+// single block at the given level.
+func blocksAtLevel(size BlockSize, level int) (int64, error) {
+	arity := int64(Arity(size))
+	n := int64(1)
+	for i := 0; i < level; i++ {
+		if n > math.MaxInt64/arity {
+			return 0, fmt.Errorf("number of content blocks: %w", ErrContentTooLarge)
+		}
+		n *= arity
+	}
+	return n, nil
+}
+
+// MaxContentSize computes the largest content that may be encoded into blocks
+// of the given size, bounded by the single byte holding the level of a read
+// capability. It is the number of content blocks of a level 255 tree, times
+// the block size, less the one byte of padding. Returns 0 for a block size
+// that cannot be encoded.
+//
+// The bound is clamped to math.MaxInt64, which is smaller than the bound for
+// both 1KiB blocks (2^1030-1 bytes) and 32KiB blocks (2^2310-1 bytes). So for
+// those sizes, the level byte is never what limits encoding.
+func MaxContentSize(size BlockSize) int64 {
+	if ValidBlockSize(size) != nil {
+		return 0
+	}
+	n, err := blocksAtLevel(size, math.MaxUint8)
+	if err != nil || n > math.MaxInt64/int64(size) {
+		return math.MaxInt64
+	}
+	return n*int64(size) - 1
+}
+
+// childCount determines the number of reference-key pairs in an unencrypted
+// inner node preceding the trailing all-zero padding pairs.
+func childCount(ub ubytes) int {
+	n := 0
+	for ; n < len(ub)/(RefSize+KeySize); n++ {
+		r, k := refKeyPairAt(ub, n)
+		if refKeyPairAllZero(r, k) {
+			break
+		}
+	}
+	return n
+}
+
+// refKeyPairAt copies the i-th reference-key pair out of an unencrypted inner
+// node.
+func refKeyPairAt(ub ubytes, i int) (r [RefSize]byte, k [KeySize]byte) {
+	off := i * (RefSize + KeySize)
+	copy(r[:], ub[off:off+RefSize])
+	copy(k[:], ub[off+RefSize:off+RefSize+KeySize])
+	return
+}
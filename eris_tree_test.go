@@ -0,0 +1,448 @@
+package eris
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// testContent deterministically generates n bytes of content that differs
+// from block to block.
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// encodeTestContent encodes n bytes of test content into 1KiB blocks,
+// returning the blocks, the root reference, and the content.
+func encodeTestContent(t *testing.T, n int) (BlockAccumulator, Ref, []byte) {
+	t.Helper()
+	content := testContent(n)
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	return b, root, content
+}
+
+func TestContentBlockAt(t *testing.T) {
+	// 40 full blocks plus a partial one gives a level 2 tree for 1KiB blocks.
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	if root.Level != 2 {
+		t.Fatalf("got level %d, want %d", root.Level, 2)
+	}
+	tests := []struct {
+		Name  string
+		Index int64
+		Want  []byte
+	}{
+		{
+			Name:  "first",
+			Index: 0,
+			Want:  content[:Size1KiB],
+		},
+		{
+			Name:  "middle",
+			Index: 17,
+			Want:  content[17*Size1KiB : 18*Size1KiB],
+		},
+		{
+			Name:  "last",
+			Index: 40,
+			Want:  content[40*Size1KiB:],
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			pt, ref, key, err := ContentBlockAt(b, root, test.Index)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if !bytes.Equal(pt, test.Want) {
+				t.Errorf("got %d bytes of plaintext, want %d bytes", len(pt), len(test.Want))
+			}
+			eb, err := b.Get(ref)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			ub, err := decrypt(eb, key)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if !bytes.HasPrefix(ub, test.Want) {
+				t.Errorf("returned ref and key do not decrypt to the plaintext")
+			}
+		})
+	}
+	t.Run("out of range", func(t *testing.T) {
+		if _, _, _, err := ContentBlockAt(b, root, 41); err == nil {
+			t.Errorf("got %v, want error", err)
+		}
+	})
+}
+
+func TestUpdateDelta(t *testing.T) {
+	content := testContent(21 * int(Size1KiB))
+	var bf, bt BlockAccumulator
+	from, err := Encode1KiB((&bf).Accumulate, bytes.NewReader(content[:20*Size1KiB]), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	to, err := Encode1KiB((&bt).Accumulate, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		if b, err := bt.Get(ref); err == nil {
+			return b, nil
+		}
+		return bf.Get(ref)
+	})
+	needed, err := UpdateDelta(s, from, to)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// The new root, the new second level 1 inner node, and the appended
+	// content block. The full padding block is shared by both trees.
+	if len(needed) != 3 {
+		t.Errorf("got %d needed refs, want %d", len(needed), 3)
+	}
+	want := make(map[string]bool)
+	for k := range bt.B {
+		if _, ok := bf.B[k]; !ok {
+			want[k] = true
+		}
+	}
+	for _, ref := range needed {
+		k := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+		if !want[k] {
+			t.Errorf("got unexpected needed ref=%s", k)
+		}
+		delete(want, k)
+	}
+	for k := range want {
+		t.Errorf("missing needed ref=%s", k)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	b, root, content := encodeTestContent(t, 40*int(Size1KiB)+100)
+	urn, err := root.URN()
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	d, err := Describe(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// 41 content blocks are referenced by 3 level 1 inner nodes, which are
+	// referenced by the level 2 root.
+	want := Description{
+		BlockSize:     Size1KiB,
+		Level:         2,
+		Blocks:        45,
+		InnerBlocks:   4,
+		ContentBlocks: 41,
+		ContentLength: int64(len(content)),
+		URN:           urn,
+	}
+	if d != want {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+}
+
+func TestContentSize(t *testing.T) {
+	for _, length := range []int{
+		0,
+		10,
+		int(Size1KiB) - 1,
+		int(Size1KiB),
+		16 * int(Size1KiB),
+		40*int(Size1KiB) + 100,
+		300 * int(Size1KiB),
+	} {
+		var b BlockAccumulator
+		root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(length)), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		var n int
+		s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+			n++
+			return b.Get(ref)
+		})
+		size, err := ContentSize(s, root)
+		if err != nil {
+			t.Errorf("%d: got %s, want %v", length, err, nil)
+		} else if size != int64(length) {
+			t.Errorf("%d: got %d, want %d", length, size, length)
+		}
+		if n != root.Level+1 {
+			t.Errorf("%d: got %d fetches, want %d", length, n, root.Level+1)
+		}
+	}
+}
+
+func TestListRefs(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Content []byte
+	}{
+		{
+			Name:    "unique blocks",
+			Content: testContent(40*int(Size1KiB) + 100),
+		},
+		{
+			Name:    "repeated blocks",
+			Content: make([]byte, 40*int(Size1KiB)),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var b BlockAccumulator
+			root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(test.Content), nil)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			refs, err := ListRefs(b, root)
+			if err != nil {
+				t.Fatalf("got %s, want %v", err, nil)
+			}
+			if len(refs) != len(b.B) {
+				t.Errorf("got %d refs, want %d", len(refs), len(b.B))
+			}
+			for _, ref := range refs {
+				k := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(ref[:])
+				if _, ok := b.B[k]; !ok {
+					t.Errorf("got unexpected ref=%s", k)
+				}
+			}
+			if refs[0] != root.Ref {
+				t.Errorf("got first ref %v, want root %v", refs[0], root.Ref)
+			}
+			// Walking visits every position in the tree.
+			var n int
+			err = WalkRefs(b, root, func(ref [RefSize]byte, level int) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Errorf("got %s, want %v", err, nil)
+			} else if n != b.N {
+				t.Errorf("got %d walked refs, want %d", n, b.N)
+			}
+		})
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	var b BlockAccumulator
+	root, st, err := EncodeStats((&b).Accumulate, bytes.NewReader(testContent(40*int(Size1KiB)+100)), nil, Size1KiB)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	// Every block is visited in the same order as WalkRefs, and the children
+	// of each inner node are the blocks visited next at the level below.
+	var want [][RefSize]byte
+	if err = WalkRefs(b, root, func(ref [RefSize]byte, level int) error {
+		want = append(want, ref)
+		return nil
+	}); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var got [][RefSize]byte
+	var contents int
+	pending := make(map[[RefSize]byte]int)
+	pending[root.Ref] = root.Level
+	err = WalkTree(b, root, func(level int, ref [RefSize]byte, children [][RefSize + KeySize]byte) error {
+		got = append(got, ref)
+		if l, ok := pending[ref]; !ok || l != level {
+			t.Errorf("got unexpected block %x at level %d", ref, level)
+		}
+		if level == 0 {
+			contents++
+			if children != nil {
+				t.Errorf("got %d children of a content block, want none", len(children))
+			}
+			return nil
+		}
+		if len(children) == 0 || len(children) > Arity(Size1KiB) {
+			t.Errorf("got %d children, want between 1 and %d", len(children), Arity(Size1KiB))
+		}
+		for _, c := range children {
+			var r [RefSize]byte
+			copy(r[:], c[:RefSize])
+			pending[r] = level - 1
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if contents != st.ContentBlocks {
+		t.Errorf("got %d content blocks, want %d", contents, st.ContentBlocks)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d blocks, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("block %d: got %x, want %x", i, got[i], want[i])
+		}
+	}
+	// An error aborts the walk.
+	stop := errors.New("stop")
+	n := 0
+	err = WalkTree(b, root, func(int, [RefSize]byte, [][RefSize + KeySize]byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("got %v after %d calls, want %v after %d", err, n, stop, 1)
+	}
+}
+
+func TestMaxContentSize(t *testing.T) {
+	tests := []struct {
+		Size BlockSize
+		Want int64
+	}{
+		{Size: Size1KiB, Want: math.MaxInt64},
+		{Size: Size32KiB, Want: math.MaxInt64},
+		{Size: 100, Want: 0},
+	}
+	for _, test := range tests {
+		if got := MaxContentSize(test.Size); got != test.Want {
+			t.Errorf("%d: got %d, want %d", test.Size, got, test.Want)
+		}
+	}
+}
+
+func TestLevelFor(t *testing.T) {
+	discard := func([]byte, [RefSize]byte, [KeySize]byte) error { return nil }
+	kib := int64(Size1KiB)
+	for _, n := range []int64{0, 1, kib - 1, kib, 16*kib - 1, 16 * kib, 256*kib - 1, 256 * kib} {
+		root, err := Encode1KiB(discard, bytes.NewReader(testContent(int(n))), nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if got := LevelFor(Size1KiB, n); got != root.Level {
+			t.Errorf("%d bytes: got level %d, want %d", n, got, root.Level)
+		}
+	}
+	tests := []struct {
+		Size  BlockSize
+		Bytes int64
+		Want  int
+	}{
+		{Size: Size32KiB, Bytes: 512*int64(Size32KiB) - 1, Want: 1},
+		{Size: Size32KiB, Bytes: 512 * int64(Size32KiB), Want: 2},
+		{Size: Size32KiB, Bytes: math.MaxInt64, Want: 6},
+		{Size: Size1KiB, Bytes: math.MaxInt64, Want: 14},
+		{Size: Size1KiB, Bytes: -1, Want: -1},
+		{Size: 100, Bytes: 1, Want: -1},
+	}
+	for _, test := range tests {
+		if got := LevelFor(test.Size, test.Bytes); got != test.Want {
+			t.Errorf("%d bytes of %d blocks: got %d, want %d", test.Bytes, test.Size, got, test.Want)
+		}
+	}
+}
+
+func TestArity(t *testing.T) {
+	if got := Arity(Size1KiB); got != 16 {
+		t.Errorf("got %d, want %d", got, 16)
+	}
+	if got := Arity(Size32KiB); got != 512 {
+		t.Errorf("got %d, want %d", got, 512)
+	}
+}
+
+func TestBlocksAtLevel(t *testing.T) {
+	tests := []struct {
+		Size  BlockSize
+		Level int
+		Want  int64
+	}{
+		{Size: Size1KiB, Level: 0, Want: 1},
+		{Size: Size1KiB, Level: 1, Want: 16},
+		{Size: Size1KiB, Level: 3, Want: 4096},
+		{Size: Size1KiB, Level: 15, Want: 1 << 60},
+		{Size: Size1KiB, Level: 16, Want: math.MaxInt64},
+		{Size: Size32KiB, Level: 2, Want: 512 * 512},
+		{Size: Size32KiB, Level: 6, Want: 1 << 54},
+		{Size: Size32KiB, Level: 7, Want: math.MaxInt64},
+		{Size: Size1KiB, Level: -1, Want: 0},
+		{Size: 100, Level: 1, Want: 0},
+	}
+	for _, test := range tests {
+		if got := BlocksAtLevel(test.Size, test.Level); got != test.Want {
+			t.Errorf("%d at level %d: got %d, want %d", test.Size, test.Level, got, test.Want)
+		}
+	}
+}
+
+// tallTree builds a tree of the level whose root has two children, each the
+// same chain of single-child inner nodes above one content block, so that its
+// content size is two full subtrees of the level below.
+func tallTree(t *testing.T, size BlockSize, level int) (BlockAccumulator, Ref) {
+	var b BlockAccumulator
+	ub := padContentBlock(ubytes("tall"), size)
+	for l := 0; l <= level; l++ {
+		eb, ref, key, err := marshalBlock(ub, nil)
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if err = b.Accumulate(eb, ref, key); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if l == level {
+			return b, Ref{BlockSize: size, Level: level, Ref: ref, Key: key}
+		}
+		ub = make(ubytes, size)
+		n := 1
+		if l == level-1 {
+			n = 2
+		}
+		for i := 0; i < n; i++ {
+			copy(ub[i*(RefSize+KeySize):], ref[:])
+			copy(ub[i*(RefSize+KeySize)+RefSize:], key[:])
+		}
+	}
+	panic("unreachable")
+}
+
+func TestContentTooLarge(t *testing.T) {
+	// Two full subtrees of 32KiB blocks at level 5 fit in an int64, while
+	// two at level 6 hold 2^70 bytes.
+	b, root := tallTree(t, Size32KiB, 6)
+	want := int64(1)<<60 + 4
+	if n, err := ContentSize(b, root); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if n != want {
+		t.Errorf("got %d, want %d", n, want)
+	}
+	b, root = tallTree(t, Size32KiB, 7)
+	if _, err := ContentSize(b, root); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+	// One more level overflows counting the content blocks.
+	b, root = tallTree(t, Size32KiB, 8)
+	if _, err := ContentSize(b, root); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+	if _, err := blocksAtLevel(Size32KiB, 7); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+	b, root = tallTree(t, Size32KiB, 6)
+	if err := DecodeRange(b, ioutil.Discard, root, math.MaxInt64, 1); !errors.Is(err, ErrContentTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrContentTooLarge)
+	}
+}
@@ -0,0 +1,202 @@
+package eris
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var _ encoding.BinaryMarshaler = new(Verifier)
+
+// Verifier verifies every block of a tree like Verify, but a few blocks at a
+// time, so that verifying a very large tree may be spread across many runs.
+//
+// Its frontier of pending inner node positions is serialized with
+// MarshalBinary and a later Verifier resumed from it with ResumeVerifier, such
+// as when scrubbing a block store whose single pass cannot finish in one
+// process. The frontier holds only child indices and the root block's
+// reference, never a read key, so it reveals nothing about the content.
+//
+// A Verifier is not safe for concurrent use.
+type Verifier struct {
+	s       Storage
+	root    Ref
+	started bool
+	done    bool
+	// Inner nodes whose children are still being verified, from the root
+	// down.
+	stack []verifyFrame
+}
+
+// verifyFrame is an inner node being walked by a Verifier.
+type verifyFrame struct {
+	level int
+	node  ubytes
+	// Index of the next child to verify.
+	next int
+}
+
+// NewVerifier creates a Verifier of the tree descendent of the root reference,
+// fetching blocks from the Storage. No blocks are fetched until Step.
+func NewVerifier(s Storage, root Ref) (*Verifier, error) {
+	if err := checkBlockSize(root.BlockSize); err != nil {
+		return nil, err
+	} else if err = checkLevel(root, 0); err != nil {
+		return nil, err
+	}
+	return &Verifier{s: s, root: root}, nil
+}
+
+// ResumeVerifier creates a Verifier continuing from a frontier previously
+// returned by MarshalBinary for the same root reference.
+//
+// The inner nodes along the path to the frontier are fetched and verified
+// again to rebuild it.
+func ResumeVerifier(s Storage, root Ref, frontier []byte) (*Verifier, error) {
+	v, err := NewVerifier(s, root)
+	if err != nil {
+		return nil, err
+	}
+	if len(frontier) < RefSize+1 {
+		return nil, errors.New("verifier frontier is too short")
+	} else if !bytes.Equal(frontier[:RefSize], root.Ref[:]) {
+		return nil, errors.New("verifier frontier is for a different root")
+	}
+	r := bytes.NewReader(frontier[RefSize+1:])
+	switch frontier[RefSize] {
+	case 0:
+		if r.Len() != 0 {
+			return nil, errors.New("verifier frontier has trailing bytes")
+		}
+		return v, nil
+	case 1:
+		v.started = true
+	default:
+		return nil, fmt.Errorf("unhandled verifier frontier state %d", frontier[RefSize])
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading verifier frontier: %w", err)
+	} else if n > uint64(root.Level) {
+		return nil, errors.New("verifier frontier is deeper than the tree")
+	}
+	level, ref, key := root.Level, root.Ref, root.Key
+	for i := uint64(0); i < n; i++ {
+		var next uint64
+		if next, err = binary.ReadUvarint(r); err != nil {
+			return nil, fmt.Errorf("reading verifier frontier: %w", err)
+		}
+		var eb ebytes
+		if eb, err = checkedGet(s, ref, root.BlockSize); err != nil {
+			return nil, VerifyError{Ref: ref, Level: level, Err: err}
+		}
+		var ub ubytes
+		if ub, err = decrypt(eb, key); err != nil {
+			return nil, VerifyError{Ref: ref, Level: level, Err: err}
+		}
+		// Every frame but the last is walking the child of the frame
+		// below it.
+		c := uint64(childCount(ub))
+		if next > c || i < n-1 && next == 0 {
+			return nil, errors.New("verifier frontier does not match the tree")
+		}
+		v.stack = append(v.stack, verifyFrame{level: level, node: ub, next: int(next)})
+		if i < n-1 {
+			ref, key = refKeyPairAt(ub, int(next)-1)
+			level--
+		}
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("verifier frontier has trailing bytes")
+	}
+	v.trim()
+	return v, nil
+}
+
+// Step verifies up to n more blocks, returning whether every block of the tree
+// has been verified.
+//
+// A block that fails verification is returned as a VerifyError. It is skipped,
+// along with its descendents, so that calling Step again continues with the
+// rest of the tree.
+func (v *Verifier) Step(n int) (done bool, err error) {
+	for i := 0; i < n && !v.done; i++ {
+		err = v.next()
+		v.trim()
+		if err != nil {
+			break
+		}
+	}
+	done = v.done
+	return
+}
+
+// Done determines whether every block of the tree has been verified.
+func (v *Verifier) Done() bool {
+	return v.done
+}
+
+// MarshalBinary serializes the frontier of the Verifier, which ResumeVerifier
+// continues from.
+//
+// The frontier is the root block's reference, a byte that is 1 once the root
+// block has been verified, then the uvarint count of inner nodes being walked
+// followed by the uvarint index of the next child of each, from the root down.
+func (v *Verifier) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, RefSize+1+binary.MaxVarintLen64*(len(v.stack)+1))
+	b = append(b, v.root.Ref[:]...)
+	if !v.started {
+		return append(b, 0), nil
+	}
+	b = append(b, 1)
+	b = binary.AppendUvarint(b, uint64(len(v.stack)))
+	for _, f := range v.stack {
+		b = binary.AppendUvarint(b, uint64(f.next))
+	}
+	return b, nil
+}
+
+// next verifies the next pending block.
+func (v *Verifier) next() error {
+	if !v.started {
+		v.started = true
+		return v.visit(v.root.Level, v.root.Ref, v.root.Key)
+	}
+	f := &v.stack[len(v.stack)-1]
+	r, k := refKeyPairAt(f.node, f.next)
+	f.next++
+	return v.visit(f.level-1, r, k)
+}
+
+// visit verifies the block, walking its children next if it is an inner node.
+func (v *Verifier) visit(level int, ref [RefSize]byte, key [KeySize]byte) error {
+	eb, err := checkedGet(v.s, ref, v.root.BlockSize)
+	if err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	} else if level == 0 {
+		return nil
+	}
+	ub, err := decrypt(eb, key)
+	if err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	} else if err = checkInnerNode(ub); err != nil {
+		return VerifyError{Ref: ref, Level: level, Err: err}
+	}
+	v.stack = append(v.stack, verifyFrame{level: level, node: ub})
+	return nil
+}
+
+// trim pops the inner nodes whose children have all been verified, noting
+// when the whole tree has been.
+func (v *Verifier) trim() {
+	for len(v.stack) > 0 {
+		f := v.stack[len(v.stack)-1]
+		if f.next < childCount(f.node) {
+			return
+		}
+		v.stack = v.stack[:len(v.stack)-1]
+	}
+	v.done = v.started
+}
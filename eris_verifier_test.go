@@ -0,0 +1,142 @@
+package eris
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 40*int(Size1KiB)+100)
+	v, err := NewVerifier(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if done, err := v.Step(math.MaxInt); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !done {
+		t.Errorf("got %v, want %v", done, true)
+	}
+	// Resume from the frontier after every few blocks, as if each run were
+	// a separate process.
+	v, err = NewVerifier(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	runs := 0
+	for !v.Done() {
+		runs++
+		if _, err = v.Step(3); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		frontier, err := v.MarshalBinary()
+		if err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+		if v, err = ResumeVerifier(b, root, frontier); err != nil {
+			t.Fatalf("got %s, want %v", err, nil)
+		}
+	}
+	// The tree has 41 content blocks, 3 level 1 nodes, and the root.
+	if runs != 15 {
+		t.Errorf("got %d runs, want %d", runs, 15)
+	}
+}
+
+func TestVerifierError(t *testing.T) {
+	b, root, _ := encodeTestContent(t, 40*int(Size1KiB)+100)
+	_, corrupt, _, err := ContentBlockAt(b, root, 20)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	var n int
+	s := StorageFunc(func(ref [RefSize]byte) ([]byte, error) {
+		n++
+		eb, err := b.Get(ref)
+		if err == nil && ref == corrupt {
+			eb = append([]byte(nil), eb...)
+			eb[10] ^= 0x01
+		}
+		return eb, err
+	})
+	v, err := NewVerifier(s, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	_, err = v.Step(math.MaxInt)
+	var verr VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want %T", err, verr)
+	} else if verr.Ref != corrupt || verr.Level != 0 {
+		t.Errorf("got level %d ref %v, want level %d ref %v", verr.Level, verr.Ref, 0, corrupt)
+	}
+	// The corrupt block is skipped, and the rest of the tree verified.
+	if done, err := v.Step(math.MaxInt); err != nil {
+		t.Errorf("got %s, want %v", err, nil)
+	} else if !done {
+		t.Errorf("got %v, want %v", done, true)
+	}
+	if n != 45 {
+		t.Errorf("got %d fetches, want %d", n, 45)
+	}
+}
+
+func TestResumeVerifierMalformed(t *testing.T) {
+	var b BlockAccumulator
+	root, err := Encode1KiB((&b).Accumulate, bytes.NewReader(testContent(40*int(Size1KiB))), nil)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	v, err := NewVerifier(b, root)
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	if _, err = v.Step(5); err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	frontier, err := v.MarshalBinary()
+	if err != nil {
+		t.Fatalf("got %s, want %v", err, nil)
+	}
+	other := root
+	other.Ref[0] ^= 0xFF
+	tests := []struct {
+		Name     string
+		Root     Ref
+		Frontier []byte
+	}{
+		{
+			Name:     "different root",
+			Root:     other,
+			Frontier: frontier,
+		},
+		{
+			Name:     "truncated",
+			Root:     root,
+			Frontier: frontier[:len(frontier)-1],
+		},
+		{
+			Name:     "trailing bytes",
+			Root:     root,
+			Frontier: append(append([]byte(nil), frontier...), 0),
+		},
+		{
+			Name:     "child out of range",
+			Root:     root,
+			Frontier: append(append([]byte(nil), frontier[:RefSize+2]...), 0x7f, 0x00),
+		},
+		{
+			Name:     "deeper than tree",
+			Root:     root,
+			Frontier: append(append([]byte(nil), frontier[:RefSize+1]...), 0x05, 1, 1, 1, 1, 1),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if _, err := ResumeVerifier(b, test.Root, test.Frontier); err == nil {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+}